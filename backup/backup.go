@@ -2,73 +2,255 @@ package backup
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/internetimagery/photos/config"
 	"github.com/internetimagery/photos/context"
 	"github.com/internetimagery/photos/format"
 	"github.com/internetimagery/photos/lock"
-	"github.com/internetimagery/photos/rename"
 )
 
-// setEnvironment : Set up environment variables for the command context
-func setEnvironment(cxt *context.Context) {
-	relpath, _ := filepath.Rel(cxt.Root, cxt.WorkingDir)
-	cxt.Env["SOURCEPATH"] = cxt.WorkingDir
+// setEnvironment : Set up environment variables for the command context, backing up the source directory
+func setEnvironment(cxt *context.Context, source string) {
+	relpath, _ := filepath.Rel(cxt.Root, source)
+	cxt.Env["SOURCEPATH"] = source
 	cxt.Env["ROOTPATH"] = cxt.Root
 	cxt.Env["WORKINGPATH"] = cxt.WorkingDir
 	cxt.Env["RELPATH"] = filepath.ToSlash(relpath)
 }
 
-// RunBackup : Run backup commands given a name. Can accept wildcards to run more than one.
-func RunBackup(cxt *context.Context, name string) error {
+// Result : Outcome of a single backup command
+type Result struct {
+	Name     string   `json:"name"`              // Name of the backup (target)
+	Event    string   `json:"event"`             // Event backed up, relative to the project root
+	Command  []string `json:"command"`           // Command that was run
+	Dest     string   `json:"dest,omitempty"`    // Where a mirror copied files to
+	Ran      bool     `json:"ran"`               // Command was run (not on a dry run)
+	Skipped  bool     `json:"skipped,omitempty"` // Event has not changed since it was last backed up. Nothing was run
+	ExitCode int      `json:"exit_code"`         // Exit status of the command
+	Error    string   `json:"error,omitempty"`   // What went wrong, if anything
+}
 
-	sortDir := filepath.Join(cxt.Root, cxt.Config.Sorted)
+// validateFile : Check a file is ready to be backed up. It needs to be formatted, within its event
+func validateFile(cxt *context.Context, filename string) error {
+	if !format.IsUsable(filename) { // Ignore any file deemed unusable
+		return nil
+	}
+	if strings.Contains(filename, context.SOURCEDIR) {
+		return fmt.Errorf("refusing to backup with source files still inside '%s'", filename)
+	}
+	if strings.HasPrefix(filename, filepath.Join(cxt.Root, cxt.Config.Sorted)) {
+		return fmt.Errorf("refusing to backup within the sorting directory '%s'", filename)
+	}
+	event := filepath.Base(filepath.Dir(filename))
+	if media := format.NewMedia(filepath.Base(filename)); media.Index == 0 || media.Event != event {
+		return fmt.Errorf("refusing to backup with unformatted files still inside '%s'", filename)
+	}
+	return nil
+}
 
+// RunBackup : Run backup commands given a name. Can accept wildcards to run more than one.
+// Commands are run once on the working directory, or with the "event" type (and mirrors) on each event within it.
+// Either way they are skipped if no lock has changed since they were last backed up under the same name.
+// Returns the outcome of each command run, stopping at the first failure.
+func RunBackup(cxt *context.Context, name string) ([]*Result, error) {
 	// Validate our project
+	events := []string{}
 	if err := filepath.Walk(cxt.WorkingDir, func(filename string, info os.FileInfo, err error) error {
 		if info.IsDir() { // Lock files in directory! Also a validation
-			return lock.LockEvent(filename, false)
+			lockResults, err := lock.LockEvent(cxt, filename, false)
+			if len(lockResults) > 0 { // Directory has media in it. Back it up on its own
+				events = append(events, filename)
+			}
+			return err
 		}
-		if !format.IsUsable(filename) { // Ignore any file deemed unusable
-			return nil
+		return validateFile(cxt, filename)
+	}); err != nil {
+		return []*Result{}, err
+	}
+	return runBackup(cxt, name, events)
+}
+
+// Skip : Event left out of a project wide backup
+type Skip struct {
+	Event  string `json:"event"`  // Event, relative to the project root
+	Reason string `json:"reason"` // Why it was left out
+}
+
+// Summary : Outcome of a project wide backup
+type Summary struct {
+	Results []*Result `json:"results"` // Outcome of each command run
+	Skipped []*Skip   `json:"skipped"` // Events that were not ready to be backed up
+}
+
+// validateEvent : Check an event is ready to be backed up, and lock it. Returns true if the directory holds media (is an event)
+func validateEvent(cxt *context.Context, directory string) (bool, error) {
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return false, err
+	}
+	usable := false
+	for _, file := range files {
+		if file.IsDir() {
+			if file.Name() == context.SOURCEDIR {
+				return true, fmt.Errorf("source files are still inside '%s'. Check them over and remove them", filepath.Join(directory, file.Name()))
+			}
+			continue
 		}
-		if strings.Contains(filename, rename.SOURCEDIR) {
-			return fmt.Errorf("refusing to backup with source files still inside '%s'", filename)
+		if format.IsUsable(file.Name()) {
+			usable = true
 		}
-		if strings.HasPrefix(filename, sortDir) {
-			return fmt.Errorf("refusing to backup within the sorting directory '%s'", filename)
+	}
+	if !usable { // Nothing here to back up
+		return false, nil
+	}
+	for _, file := range files {
+		if !file.IsDir() {
+			if err = validateFile(cxt, filepath.Join(directory, file.Name())); err != nil {
+				return true, err
+			}
 		}
-		event := filepath.Base(filepath.Dir(filename))
-		if media := format.NewMedia(info.Name()); media.Index == 0 || media.Event != event {
-			return fmt.Errorf("refusing to backup with unformatted files still inside '%s'", filename)
+	}
+	_, err = lock.LockEvent(cxt, directory, false)
+	return true, err
+}
+
+// BackupProject : Run backup commands given a name (same as RunBackup) on every event in the project (see context.WalkEvents for what is left out).
+// Events that are not ready to be backed up (ie unformatted files, or files changed since locking) are skipped rather than stopping the backup, and reported in the summary.
+// Only commands run on each event ("event" type and mirrors) can leave them out. Others back up the project as a whole.
+func BackupProject(cxt *context.Context, name string) (*Summary, error) {
+	summary := &Summary{Results: []*Result{}, Skipped: []*Skip{}}
+	events := []string{}
+	err := cxt.WalkEvents(func(filename string) error {
+		event, err := validateEvent(cxt, filename)
+		if err != nil {
+			if _, ok := err.(*os.PathError); ok && !event { // Could not read the directory
+				return err
+			}
+			relpath, _ := filepath.Rel(cxt.Root, filename)
+			log.Println("Skipping:", filename, err)
+			summary.Skipped = append(summary.Skipped, &Skip{Event: filepath.ToSlash(relpath), Reason: err.Error()})
+		} else if event {
+			events = append(events, filename)
 		}
 		return nil
-	}); err != nil {
-		return err
+	})
+	if err != nil {
+		return summary, err
+	}
+	if len(events) == 0 {
+		log.Println("No events ready to back up")
+		return summary, nil
+	}
+	summary.Results, err = runBackup(cxt, name, events)
+	return summary, err
+}
+
+// runBackup : Run backup commands given a name, on the working directory or each event (see RunBackup).
+// Events are skipped if their lock has not changed since they were last backed up under the same name
+func runBackup(cxt *context.Context, name string, events []string) ([]*Result, error) {
+	results := []*Result{}
+
+	// Load up what has been backed up before
+	ledger, err := ReadLedger(cxt.Root)
+	if err != nil {
+		return results, err
 	}
 
-	// Prep our environment for command
-	setEnvironment(cxt)
+	// Get the lock state of each event, to compare against the ledger
+	states := map[string]map[string]string{}
+	for _, event := range events {
+		if states[event], err = LockState(event); err != nil {
+			return results, err
+		}
+	}
 
-	// Get our command
-	commands := cxt.Config.Backup.GetCommands(name)
+	// Get our commands
 	run := 0
-	for _, command := range commands {
-		if command != "" {
-			run++
+	for _, command := range cxt.Config.Backup.Find(name) {
+		if command.Command == "" && command.Type != config.MIRROR {
+			continue
+		}
+		run++
+		if command.Type == "" { // Back up the working directory as a whole
+			relpath := relPath(cxt, cxt.WorkingDir)
+			changed := len(events) == 0 // Nothing locked. Nothing to compare
+			for _, event := range events {
+				if !ledger.Get(command.Name, relPath(cxt, event)).Matches(states[event]) {
+					changed = true
+				}
+			}
+			if !changed { // Nothing has changed since last time
+				log.Println("Skipping (unchanged since last backup):", cxt.WorkingDir)
+				results = append(results, &Result{Name: command.Name, Event: relpath, Skipped: true})
+				continue
+			}
+			setEnvironment(cxt, cxt.WorkingDir)
+			result := &Result{Name: command.Name, Event: relpath}
+			results = append(results, result)
+			if err = runCommand(cxt, command.Command, result); err != nil {
+				return results, err
+			}
+			if cxt.Journal.IsDryRun() {
+				continue
+			}
 
-			// Run our backup command
-			com, err := cxt.PrepCommand(command)
-			if err != nil {
-				return err
+			// Record our success
+			for _, event := range events {
+				ledger.Set(command.Name, relPath(cxt, event), &Record{Time: time.Now(), Files: states[event]})
 			}
-			log.Println("Running:", com.Args)
-			err = com.Run()
-			if err != nil {
-				return err
+			if err = WriteLedger(cxt.Root, ledger); err != nil {
+				return results, err
+			}
+			continue
+		}
+
+		targets := events
+		if len(targets) == 0 { // Nothing locked yet. Back up the directory as a whole
+			targets = []string{cxt.WorkingDir}
+			if states[cxt.WorkingDir], err = LockState(cxt.WorkingDir); err != nil {
+				return results, err
+			}
+		}
+		for _, event := range targets {
+			relpath := relPath(cxt, event)
+			files := states[event]
+			if ledger.Get(command.Name, relpath).Matches(files) { // Nothing has changed since last time
+				log.Println("Skipping (unchanged since last backup):", event)
+				results = append(results, &Result{Name: command.Name, Event: relpath, Skipped: true})
+				continue
+			}
+
+			// Prep our environment, and run our backup command
+			setEnvironment(cxt, event)
+			if command.Type == config.MIRROR { // No command to run. Copy files across ourselves
+				result := &Result{Name: command.Name, Event: relpath, Ran: !cxt.Journal.IsDryRun(), Dest: command.Dest}
+				results = append(results, result)
+				if err = mirror(cxt, event, command.Dest); err != nil {
+					result.Error = err.Error()
+					return results, err
+				}
+			} else {
+				result := &Result{Name: command.Name, Event: relpath}
+				results = append(results, result)
+				if err = runCommand(cxt, command.Command, result); err != nil {
+					return results, err
+				}
+			}
+			if cxt.Journal.IsDryRun() {
+				continue
+			}
+
+			// Record our success
+			ledger.Set(command.Name, relpath, &Record{Time: time.Now(), Files: files})
+			if err = WriteLedger(cxt.Root, ledger); err != nil {
+				return results, err
 			}
 		}
 	}
@@ -77,5 +259,34 @@ func RunBackup(cxt *context.Context, name string) error {
 	if run == 0 {
 		log.Printf("No commands match the name '%s'\n", name)
 	}
+	return results, nil
+}
+
+// relPath : Path relative to the project root, with forward slashes. As recorded in results and the ledger
+func relPath(cxt *context.Context, filename string) string {
+	relpath, _ := filepath.Rel(cxt.Root, filename)
+	return filepath.ToSlash(relpath)
+}
+
+// runCommand : Run a backup command, filling in its result. Reported but not run on a dry run
+func runCommand(cxt *context.Context, command string, result *Result) error {
+	com, err := cxt.PrepCommand(command)
+	if err != nil {
+		return err
+	}
+	log.Println("Running:", com.Args)
+	result.Command = com.Args
+	if cxt.Journal.IsDryRun() { // Report only
+		return nil
+	}
+	result.Ran = true
+	if err = com.Run(); err != nil {
+		result.Error = err.Error()
+		result.ExitCode = -1 // Command could not be run
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			result.ExitCode = exitErr.ExitCode()
+		}
+		return err
+	}
 	return nil
 }
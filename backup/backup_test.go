@@ -1,11 +1,14 @@
 package backup
 
 import (
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"runtime"
 	"testing"
 
 	"github.com/internetimagery/photos/context"
+	"github.com/internetimagery/photos/lock"
 	"github.com/internetimagery/photos/testutil"
 )
 
@@ -38,8 +41,11 @@ func TestRunBackup(t *testing.T) {
 	// File should now exist
 	tu.AssertExists(cxt.Env["TESTPATH1"])
 
-	// Test command star
-	tu.Must(RunBackup(cxt, "othe*"))
+	// Test command star, reporting each command run
+	results := tu.Must(RunBackup(cxt, "othe*")).([]*Result)
+	if len(results) != 2 || !results[0].Ran || results[0].ExitCode != 0 {
+		tu.Fail("Expected two successful commands. Got", results)
+	}
 
 	// Files should now exist
 	tu.AssertExists(cxt.Env["TESTPATH2"])
@@ -54,7 +60,7 @@ func TestBackupBadCommand(t *testing.T) {
 	event := filepath.Join(tu.Dir, "event01")
 	cxt := tu.MustFatal(context.NewContext(event)).(*context.Context)
 
-	if err := RunBackup(cxt, "test"); err == nil {
+	if _, err := RunBackup(cxt, "test"); err == nil {
 		tu.Fail("Passed on bad command!")
 	}
 }
@@ -66,7 +72,7 @@ func TestBackupContainsSource(t *testing.T) {
 	event := filepath.Join(tu.Dir, "event01")
 	cxt := tu.MustFatal(context.NewContext(event)).(*context.Context)
 
-	if err := RunBackup(cxt, "test"); err == nil {
+	if _, err := RunBackup(cxt, "test"); err == nil {
 		tu.Fail("Allowed backup with source files still present.")
 	}
 }
@@ -78,7 +84,7 @@ func TestBackupContainsUnformatted(t *testing.T) {
 	event := filepath.Join(tu.Dir, "event01")
 	cxt := tu.MustFatal(context.NewContext(event)).(*context.Context)
 
-	if err := RunBackup(cxt, "test"); err == nil {
+	if _, err := RunBackup(cxt, "test"); err == nil {
 		tu.Fail("Allowed backup with source files still unformatted.")
 	}
 }
@@ -97,7 +103,7 @@ func TestSetEnviron(t *testing.T) {
 	}
 
 	// Set up our environment
-	setEnvironment(cxt)
+	setEnvironment(cxt, working)
 
 	testCase := map[string]string{
 		"SOURCEPATH":  working,
@@ -112,3 +118,287 @@ func TestSetEnviron(t *testing.T) {
 		}
 	}
 }
+
+func TestBackupLedger(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	year := filepath.Join(tu.Dir, "2018")
+	cxt := tu.MustFatal(context.NewContext(year)).(*context.Context)
+
+	// Check which events were backed up (not skipped)
+	backedUp := func(results []*Result) map[string]bool {
+		events := map[string]bool{}
+		for _, result := range results {
+			events[result.Event] = result.Ran
+		}
+		return events
+	}
+
+	// Each event is backed up on its own, the first time round
+	results := tu.Must(RunBackup(cxt, "test")).([]*Result)
+	if events := backedUp(results); len(events) != 2 || !events["2018/event01"] || !events["2018/event02"] {
+		tu.Fail("Expected both events to be backed up. Got", events)
+	}
+	tu.AssertExists(filepath.Join(tu.Dir, LEDGERFILE))
+
+	// Nothing changed. Nothing to do
+	results = tu.Must(RunBackup(cxt, "test")).([]*Result)
+	if events := backedUp(results); len(events) != 2 || events["2018/event01"] || events["2018/event02"] {
+		tu.Fail("Expected both events to be skipped. Got", events)
+	}
+
+	// Only the changed event is backed up
+	tu.MustFatal(ioutil.WriteFile(filepath.Join(year, "event02", "event02_002.txt"), []byte("three"), 0644))
+	results = tu.Must(RunBackup(cxt, "test")).([]*Result)
+	if events := backedUp(results); len(events) != 2 || events["2018/event01"] || !events["2018/event02"] {
+		tu.Fail("Expected only the changed event to be backed up. Got", events)
+	}
+
+	ledger := tu.Must(ReadLedger(tu.Dir)).(Ledger)
+	if record := ledger.Get("test", "2018/event02"); record == nil || len(record.Files) != 2 {
+		tu.Fail("Ledger did not record the changed event. Got", record)
+	}
+}
+
+func TestBackupWorkingDir(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	year := filepath.Join(tu.Dir, "2018")
+	cxt := tu.MustFatal(context.NewContext(year)).(*context.Context)
+
+	// Commands without a type run once, on the working directory
+	results := tu.Must(RunBackup(cxt, "test")).([]*Result)
+	if len(results) != 1 || results[0].Event != "2018" || !results[0].Ran {
+		tu.Fail("Expected the working directory to be backed up once. Got", results)
+	}
+	if cxt.Env["SOURCEPATH"] != year || cxt.Env["RELPATH"] != "2018" {
+		tu.Fail("Expected the working directory in the environment. Got", cxt.Env["SOURCEPATH"], cxt.Env["RELPATH"])
+	}
+	ledger := tu.Must(ReadLedger(tu.Dir)).(Ledger)
+	if ledger.Get("test", "2018/event01") == nil || ledger.Get("test", "2018/event02") == nil {
+		tu.Fail("Ledger did not record both events. Got", ledger)
+	}
+
+	// Nothing changed. Nothing to do
+	results = tu.Must(RunBackup(cxt, "test")).([]*Result)
+	if len(results) != 1 || !results[0].Skipped || results[0].Ran {
+		tu.Fail("Expected the backup to be skipped. Got", results)
+	}
+
+	// Any change backs up the whole directory again
+	tu.MustFatal(ioutil.WriteFile(filepath.Join(year, "event02", "event02_002.txt"), []byte("three"), 0644))
+	results = tu.Must(RunBackup(cxt, "test")).([]*Result)
+	if len(results) != 1 || results[0].Event != "2018" || !results[0].Ran {
+		tu.Fail("Expected the working directory to be backed up again. Got", results)
+	}
+}
+
+func TestGetStatus(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	event := filepath.Join(tu.Dir, "2018", "event01")
+	cxt := tu.MustFatal(context.NewContext(event)).(*context.Context)
+	tu.MustFatal(RunBackup(cxt, "a"))
+
+	// Look up statuses by event and name
+	getStatus := func() map[string]*Status {
+		statuses := map[string]*Status{}
+		for _, status := range tu.Must(GetStatus(cxt)).([]*Status) {
+			statuses[status.Event+" "+status.Name] = status
+		}
+		return statuses
+	}
+
+	statuses := getStatus()
+	if len(statuses) != 4 {
+		tu.FailNow("Expected two events against two backups. Got", statuses)
+	}
+	if status := statuses["2018/event01 a"]; !status.BackedUp || status.Changed || status.Time.IsZero() {
+		tu.Fail("Expected event01 to be backed up to a. Got", status)
+	}
+	for _, key := range []string{"2018/event01 b", "2018/event02 a", "2018/event02 b"} {
+		if statuses[key].BackedUp {
+			tu.Fail("Unexpected backup", key)
+		}
+	}
+
+	// Changing the lock shows up as changed
+	tu.MustFatal(ioutil.WriteFile(filepath.Join(event, "event01_002.txt"), []byte("three"), 0644))
+	tu.MustFatal(lock.LockEvent(cxt, event, false))
+	if status := getStatus()["2018/event01 a"]; !status.BackedUp || !status.Changed {
+		tu.Fail("Expected event01 to have changed since backup. Got", status)
+	}
+}
+
+func TestBackupMirror(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	mirrorDir := tu.MustFatal(ioutil.TempDir("", "mirror")).(string)
+	defer os.RemoveAll(mirrorDir)
+
+	event := filepath.Join(tu.Dir, "event01")
+	mirrored := filepath.Join(mirrorDir, "event01")
+	cxt := tu.MustFatal(context.NewContext(event)).(*context.Context)
+	cxt.Env["MIRRORPATH"] = mirrorDir
+
+	results := tu.Must(RunBackup(cxt, "nas")).([]*Result)
+	if len(results) != 1 || !results[0].Ran || results[0].Dest != "$MIRRORPATH" {
+		tu.Fail("Expected mirror to run. Got", results)
+	}
+	tu.AssertExists(filepath.Join(mirrored, "event01_002.txt"), filepath.Join(mirrored, lock.LOCKFILENAME))
+	testfile := filepath.Join(mirrored, "event01_001.txt")
+	if data := tu.MustFatal(ioutil.ReadFile(testfile)).([]byte); string(data) != "one\n" {
+		tu.FailE("one\n", string(data))
+	}
+	if info := tu.MustFatal(os.Stat(testfile)).(os.FileInfo); info.Mode().Perm()&0222 != 0 {
+		tu.Fail("Mirrored file is not read only", info.Mode())
+	}
+
+	// Files in the mirror that do not match are reported, not overwritten
+	tu.MustFatal(os.Chmod(testfile, 0644))
+	tu.MustFatal(ioutil.WriteFile(testfile, []byte("changed"), 0644))
+	tu.MustFatal(os.Remove(filepath.Join(tu.Dir, LEDGERFILE)))
+	if _, err := RunBackup(cxt, "nas"); err == nil {
+		tu.Fail("Allowed mirror over a file that does not match")
+	}
+	if data := tu.MustFatal(ioutil.ReadFile(testfile)).([]byte); string(data) != "changed" {
+		tu.FailE("changed", string(data))
+	}
+
+	// Mirrors cannot be kept within the project
+	for _, dest := range []string{"mirror", filepath.Join(tu.Dir, "mirror"), tu.Dir} {
+		cxt.Env["MIRRORPATH"] = dest
+		if _, err := RunBackup(cxt, "nas"); err == nil {
+			tu.Fail("Allowed mirror into", dest)
+		}
+	}
+	tu.AssertNotExists(filepath.Join(tu.Dir, "mirror"))
+}
+
+func TestRestore(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	mirrorDir := tu.MustFatal(ioutil.TempDir("", "mirror")).(string)
+	defer os.RemoveAll(mirrorDir)
+
+	event := filepath.Join(tu.Dir, "event01")
+	testfile1 := filepath.Join(event, "event01_001.txt")
+	testfile2 := filepath.Join(event, "event01_002.txt")
+	cxt := tu.MustFatal(context.NewContext(event)).(*context.Context)
+	cxt.Env["MIRRORPATH"] = mirrorDir
+	tu.MustFatal(RunBackup(cxt, "nas"))
+
+	// Fresh backup matches the lock
+	results := tu.Must(VerifyBackup(cxt, "nas")).(lock.Results)
+	if len(results) != 2 || results.Err() != nil {
+		tu.Fail("Expected backup to match. Got", results)
+	}
+
+	// Damage our files, then bring them back
+	tu.MustFatal(os.Chmod(testfile1, 0644))
+	tu.MustFatal(ioutil.WriteFile(testfile1, []byte("damaged"), 0644))
+	tu.MustFatal(os.Remove(testfile2))
+	results = tu.Must(Restore(cxt, "nas", []string{event})).(lock.Results)
+	if len(results) != 2 || results[0].State != lock.SIZECHANGED || results[1].State != lock.MISSING {
+		tu.Fail("Expected damaged and missing files to be restored. Got", results)
+	}
+	if data := tu.MustFatal(ioutil.ReadFile(testfile1)).([]byte); string(data) != "one\n" {
+		tu.FailE("one\n", string(data))
+	}
+	tu.AssertExists(testfile2, filepath.Join(tu.Dir, context.CORRUPTED, "event01", "event01_001.txt"))
+	if err := tu.Must(lock.VerifyEvent(event)).(lock.Results).Err(); err != nil {
+		tu.Fail(err)
+	}
+
+	// Damaged backups are reported
+	mirrored := filepath.Join(mirrorDir, "event01", "event01_002.txt")
+	tu.MustFatal(os.Chmod(mirrored, 0644))
+	tu.MustFatal(ioutil.WriteFile(mirrored, []byte("owt\n"), 0644))
+	results = tu.Must(VerifyBackup(cxt, "nas")).(lock.Results)
+	if len(results) != 2 || results[1].State != lock.MODIFIED {
+		tu.Fail("Expected damaged backup to be reported. Got", results)
+	}
+	if _, ok := results.Err().(*lock.MissmatchError); !ok {
+		tu.Fail("Damaged backup not reported as a missmatch")
+	}
+	if _, err := VerifyBackup(cxt, "nothing"); err == nil {
+		tu.Fail("Verified backup that does not exist")
+	}
+}
+
+func TestRestoreFallback(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	mirrorDir1 := tu.MustFatal(ioutil.TempDir("", "mirror")).(string)
+	defer os.RemoveAll(mirrorDir1)
+	mirrorDir2 := tu.MustFatal(ioutil.TempDir("", "mirror")).(string)
+	defer os.RemoveAll(mirrorDir2)
+
+	event := filepath.Join(tu.Dir, "event01")
+	testfile1 := filepath.Join(event, "event01_001.txt")
+	testfile2 := filepath.Join(event, "event01_002.txt")
+	marker := filepath.Join(tu.Dir, "marker")
+	cxt := tu.MustFatal(context.NewContext(event)).(*context.Context)
+	cxt.Env["MIRRORPATH1"] = mirrorDir1
+	cxt.Env["MIRRORPATH2"] = mirrorDir2
+	cxt.Env["MARKER"] = marker
+	tu.MustFatal(RunBackup(cxt, "nas*"))
+
+	// First backup is missing a file, so it comes from the second
+	tu.MustFatal(os.Remove(filepath.Join(mirrorDir1, "event01", "event01_002.txt")))
+	tu.MustFatal(os.Remove(testfile1))
+	tu.MustFatal(os.Remove(testfile2))
+	results := tu.Must(Restore(cxt, "nas*", []string{event})).(lock.Results)
+	if len(results) != 2 || results[0].State != lock.MISSING || results[1].State != lock.MISSING {
+		tu.Fail("Expected both missing files to be restored. Got", results)
+	}
+	if err := tu.Must(lock.VerifyEvent(event)).(lock.Results).Err(); err != nil {
+		tu.Fail(err)
+	}
+
+	// Not in any backup
+	tu.MustFatal(os.Remove(filepath.Join(mirrorDir2, "event01", "event01_002.txt")))
+	tu.MustFatal(os.Remove(testfile2))
+	if _, err := Restore(cxt, "nas*", []string{event}); err == nil {
+		tu.Fail("Restored a file that is not backed up")
+	}
+	tu.AssertNotExists(testfile2)
+
+	// Restore commands are not run on a dry run
+	cxt.Journal.DryRun = true
+	results = tu.Must(Restore(cxt, "cloud", []string{event})).(lock.Results)
+	if len(results) != 1 || results[0].State != lock.MISSING {
+		tu.Fail("Expected missing file to be reported. Got", results)
+	}
+	results = tu.Must(VerifyBackup(cxt, "cloud")).(lock.Results)
+	if len(results) != 0 {
+		tu.Fail("Expected nothing to be checked on a dry run. Got", results)
+	}
+	tu.AssertNotExists(marker, testfile2)
+}
+
+func TestBackupProject(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	cxt := tu.MustFatal(context.NewContext(tu.Dir)).(*context.Context)
+	summary := tu.Must(BackupProject(cxt, "test")).(*Summary)
+	if len(summary.Results) != 1 || summary.Results[0].Event != "2018/good" || !summary.Results[0].Ran {
+		tu.Fail("Expected only the good event to be backed up. Got", summary.Results)
+	}
+	skipped := map[string]string{}
+	for _, skip := range summary.Skipped {
+		skipped[skip.Event] = skip.Reason
+	}
+	if len(skipped) != 2 || skipped["2018/source"] == "" || skipped["2018/unformatted"] == "" {
+		tu.Fail("Expected events with source and unformatted files to be skipped. Got", skipped)
+	}
+	tu.AssertExists(filepath.Join(tu.Dir, "2018", "good", lock.LOCKFILENAME))
+	tu.AssertNotExists(filepath.Join(tu.Dir, "2018", "unformatted", lock.LOCKFILENAME))
+}
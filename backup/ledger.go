@@ -0,0 +1,161 @@
+package backup
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/internetimagery/photos/context"
+	"github.com/internetimagery/photos/format"
+	"github.com/internetimagery/photos/lock"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// LEDGERFILE : Name of file (at the project root) recording what has been backed up where
+const LEDGERFILE = "photos-backup.yaml"
+
+// Record : State of an event the last time it was successfully backed up
+type Record struct {
+	Time  time.Time         `yaml:"time" json:"time"`   // When the backup finished
+	Files map[string]string `yaml:"files" json:"files"` // Locked files mapped to their content hash (from locked.yaml)
+}
+
+// Matches : Check the event is in the same state as when it was backed up
+func (record *Record) Matches(files map[string]string) bool {
+	if record == nil || len(record.Files) != len(files) {
+		return false
+	}
+	for name, hash := range files {
+		if recorded, ok := record.Files[name]; !ok || recorded != hash {
+			return false
+		}
+	}
+	return true
+}
+
+// Ledger : Backup names (targets) mapped to the events backed up to them. Events are relative to the project root (forward slashes)
+type Ledger map[string]map[string]*Record
+
+// Get : Get the record of an event backed up to a target. Nil if it has never been backed up
+func (ledger Ledger) Get(name, event string) *Record {
+	return ledger[name][event]
+}
+
+// Set : Record an event being backed up to a target
+func (ledger Ledger) Set(name, event string, record *Record) {
+	if _, ok := ledger[name]; !ok {
+		ledger[name] = map[string]*Record{}
+	}
+	ledger[name][event] = record
+}
+
+// ReadLedger : Load the ledger from the project root. An empty ledger if nothing has been backed up yet
+func ReadLedger(root string) (Ledger, error) {
+	ledger := Ledger{}
+	handle, err := os.Open(filepath.Join(root, LEDGERFILE))
+	if os.IsNotExist(err) {
+		return ledger, nil
+	} else if err != nil {
+		return ledger, err
+	}
+	defer handle.Close()
+	if err = yaml.NewDecoder(handle).Decode(&ledger); err != nil && err != io.EOF {
+		return ledger, err
+	}
+	return ledger, nil
+}
+
+// WriteLedger : Save the ledger into the project root, replacing what was there
+func WriteLedger(root string, ledger Ledger) error {
+	data, err := yaml.Marshal(ledger)
+	if err != nil {
+		return err
+	}
+	handle, err := os.OpenFile(filepath.Join(root, LEDGERFILE), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = handle.Write(data); err != nil {
+		handle.Close()
+		return err
+	}
+	return handle.Close()
+}
+
+// LockState : Content hashes of the files locked in an event, keyed by name. Empty if the event is not locked
+func LockState(eventPath string) (map[string]string, error) {
+	files := map[string]string{}
+	lockmap, err := lock.ReadLockFile(eventPath)
+	if os.IsNotExist(err) {
+		return files, nil
+	} else if err != nil {
+		return files, err
+	}
+	for name, sshot := range lockmap {
+		files[name] = sshot.ContentHash["SHA256"]
+	}
+	return files, nil
+}
+
+// Status : Where an event stands with a backup (target)
+type Status struct {
+	Name     string    `json:"name"`           // Name of the backup (target)
+	Event    string    `json:"event"`          // Event, relative to the project root
+	BackedUp bool      `json:"backed_up"`      // Event has been backed up to the target
+	Time     time.Time `json:"time,omitempty"` // When it was last backed up
+	Changed  bool      `json:"changed"`        // Lock has changed since it was last backed up
+}
+
+// GetStatus : Report on every event in the project, against every backup (target) in the config. Ordered by event, then by backup.
+// Events are directories holding locked or formatted media (see context.WalkEvents for what is left out).
+func GetStatus(cxt *context.Context) ([]*Status, error) {
+	statuses := []*Status{}
+	ledger, err := ReadLedger(cxt.Root)
+	if err != nil {
+		return statuses, err
+	}
+	names := []string{}
+	seen := map[string]struct{}{}
+	for _, command := range cxt.Config.Backup {
+		if _, ok := seen[command.Name]; !ok {
+			seen[command.Name] = struct{}{}
+			names = append(names, command.Name)
+		}
+	}
+	err = cxt.WalkEvents(func(eventPath string) error {
+		files, err := LockState(eventPath)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 { // Not locked. Is there anything to back up?
+			mediaList, err := format.GetMediaFromDirectory(eventPath)
+			if err != nil {
+				return err
+			}
+			formatted := false
+			for _, media := range mediaList {
+				if media.Index > 0 {
+					formatted = true
+					break
+				}
+			}
+			if !formatted {
+				return nil
+			}
+		}
+		relpath, _ := filepath.Rel(cxt.Root, eventPath)
+		relpath = filepath.ToSlash(relpath)
+		for _, name := range names {
+			status := &Status{Name: name, Event: relpath}
+			if record := ledger.Get(name, relpath); record != nil {
+				status.BackedUp = true
+				status.Time = record.Time
+				status.Changed = !record.Matches(files)
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
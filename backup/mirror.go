@@ -0,0 +1,121 @@
+package backup
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	gosort "sort"
+
+	"github.com/internetimagery/photos/context"
+	"github.com/internetimagery/photos/copy"
+	"github.com/internetimagery/photos/lock"
+	"github.com/internetimagery/photos/progress"
+)
+
+// mirrorPath : Where a mirror keeps its copy of a directory within the project. Environment variables in dest are expanded.
+// Dest must be an absolute path outside the project, so the mirror is never mistaken for (or backed up as) part of it
+func mirrorPath(cxt *context.Context, dest, directory string) (string, error) {
+	dest = filepath.Clean(os.Expand(dest, func(name string) string { return cxt.Env[name] }))
+	if !filepath.IsAbs(dest) {
+		return "", fmt.Errorf("mirror dest '%s' is not an absolute path", dest)
+	}
+	if context.Within(cxt.Root, dest) {
+		return "", fmt.Errorf("mirror dest '%s' is inside the project", dest)
+	}
+	relpath, err := filepath.Rel(cxt.Root, directory)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dest, relpath), nil
+}
+
+// mirror : Copy the locked files of an event (and its lockfile) into the same place within dest. Each copy is checked against the lock, and made read only.
+// Files already in the mirror are left alone if they match the lock, and reported if they do not (never overwritten).
+func mirror(cxt *context.Context, event, dest string) error {
+	lockmap, err := lock.ReadLockFile(event)
+	if os.IsNotExist(err) {
+		log.Println("Nothing locked to mirror:", event)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	destDir, err := mirrorPath(cxt, dest, event)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for name := range lockmap {
+		names = append(names, name)
+	}
+	gosort.Strings(names)
+
+	// Keep track of how far along we are
+	report := progress.NewReporter("mirror")
+	defer report.Close()
+	for _, name := range names {
+		report.Expect(1, lockmap[name].Size)
+	}
+
+	if !cxt.Journal.IsDryRun() {
+		if err = os.MkdirAll(destDir, 0755); err != nil {
+			return err
+		}
+	}
+	conflicts := 0
+	for _, name := range names {
+		source, destination := filepath.Join(event, name), filepath.Join(destDir, name)
+		expected := lockmap[name].ContentHash["SHA256"]
+
+		// Check what is already there
+		hash, err := lock.HashFile(destination)
+		if err == nil {
+			if hash != expected {
+				log.Println("Conflict (not overwriting, does not match the lock):", destination)
+				conflicts++
+			} else if !cxt.Journal.IsDryRun() {
+				if err = lock.ReadOnly(destination); err != nil {
+					return err
+				}
+			}
+			report.Done(source, lockmap[name].Size)
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		// Copy it across
+		log.Println("Mirroring:", source, "--->", destination)
+		if cxt.Journal.IsDryRun() {
+			report.Done(source, lockmap[name].Size)
+			continue
+		}
+		report.Status("Copying", source)
+		if hash, err = lock.HashFile(source); err != nil {
+			return err
+		}
+		if hash != expected {
+			return fmt.Errorf("'%s' does not match the lock. Has it changed since it was locked?", source)
+		}
+		if err = <-copy.FileVerify(source, destination, lock.ContentHash); err != nil {
+			return err
+		}
+		if err = lock.ReadOnly(destination); err != nil {
+			return err
+		}
+		report.Done(source, lockmap[name].Size)
+	}
+	if conflicts > 0 {
+		return fmt.Errorf("%d file(s) in '%s' do not match the lock, and were left alone", conflicts, destDir)
+	}
+
+	// Finally bring the lock along, so the mirror can be checked against it later
+	if cxt.Journal.IsDryRun() {
+		return nil
+	}
+	lockfile := filepath.Join(destDir, lock.LOCKFILENAME)
+	if err = os.Remove(lockfile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return <-copy.FileVerify(filepath.Join(event, lock.LOCKFILENAME), lockfile, lock.ContentHash)
+}
@@ -0,0 +1,259 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	gosort "sort"
+
+	"github.com/internetimagery/photos/config"
+	"github.com/internetimagery/photos/context"
+	"github.com/internetimagery/photos/lock"
+	"github.com/internetimagery/photos/sort"
+)
+
+// Reasons a backup cannot restore a file, where another backup might
+var (
+	errNotBackedUp = errors.New("not in the backup")
+	errBadBackup   = errors.New("backed up copy does not match the lock")
+)
+
+// readable : Backups (targets) matching name that can be read back. Mirrors, or those with a restore command
+func readable(cxt *context.Context, name string) (config.BackupCategory, error) {
+	found := config.BackupCategory{}
+	for _, command := range cxt.Config.Backup.Find(name) {
+		if command.Type == config.MIRROR || command.Restore != "" {
+			found = append(found, command)
+		}
+	}
+	if len(found) == 0 {
+		return found, fmt.Errorf("no backups matching the name '%s' can be read back. Use a mirror, or add a restore command", name)
+	}
+	return found, nil
+}
+
+// LockedEvents : Find all locked events within a directory (see context.WalkEvents for what is left out)
+func LockedEvents(cxt *context.Context, directory string) ([]string, error) {
+	events := []string{}
+	err := cxt.WalkEventsIn(directory, func(filename string) error {
+		if _, err := os.Stat(filepath.Join(filename, lock.LOCKFILENAME)); err == nil {
+			events = append(events, filename)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+	return events, err
+}
+
+// readBack : Get a directory holding the backed up copy of an event. Mirrors are read in place.
+// Otherwise the restore command fetches the copy (from $RELPATH) into a temporary directory ($RESTOREPATH), removed by calling cleanup.
+// On a dry run the restore command is reported but not run, and the directory is empty ("").
+func readBack(cxt *context.Context, command config.Command, event string) (string, func(), error) {
+	cleanup := func() {}
+	if command.Type == config.MIRROR {
+		dir, err := mirrorPath(cxt, command.Dest, event)
+		return dir, cleanup, err
+	}
+	dir, err := ioutil.TempDir("", "photos-restore")
+	if err != nil {
+		return "", cleanup, err
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	setEnvironment(cxt, event)
+	cxt.Env["RESTOREPATH"] = dir
+	com, err := cxt.PrepCommand(command.Restore)
+	if err != nil {
+		cleanup()
+		return "", func() {}, err
+	}
+	log.Println("Running:", com.Args)
+	if cxt.Journal.IsDryRun() { // Report only
+		cleanup()
+		return "", func() {}, nil
+	}
+	if err = com.Run(); err != nil {
+		cleanup()
+		return "", func() {}, err
+	}
+	return dir, cleanup, nil
+}
+
+// checkBackup : Compare the backed up copy of an event (in dir) to the lock. Results refer to the files in the project
+func checkBackup(event, dir string, lockmap lock.LockMap) (lock.Results, error) {
+	results := lock.Results{}
+	names := []string{}
+	for name := range lockmap {
+		names = append(names, name)
+	}
+	gosort.Strings(names)
+	for _, name := range names {
+		result := &lock.Result{Path: filepath.Join(event, name), State: lock.UNCHANGED}
+		hash, err := lock.HashFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			result.State, result.Detail = lock.MISSING, "Not in the backup: "+name
+		} else if err != nil {
+			return results, err
+		} else if hash != lockmap[name].ContentHash["SHA256"] {
+			result.State, result.Detail = lock.MODIFIED, "Backed up copy does not match: "+name
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// VerifyBackup : Check the backed up copy of every locked event within the working directory against the lock, for backups matching name.
+// Only backups that can be read back are checked (mirrors, or those with a restore command).
+func VerifyBackup(cxt *context.Context, name string) (lock.Results, error) {
+	results := lock.Results{}
+	commands, err := readable(cxt, name)
+	if err != nil {
+		return results, err
+	}
+	events, err := LockedEvents(cxt, cxt.WorkingDir)
+	if err != nil {
+		return results, err
+	}
+	for _, command := range commands {
+		for _, event := range events {
+			lockmap, err := lock.ReadLockFile(event)
+			if err != nil {
+				return results, err
+			}
+			dir, cleanup, err := readBack(cxt, command, event)
+			if err != nil {
+				return results, err
+			}
+			if dir == "" { // Dry run. Nothing to check
+				continue
+			}
+			eventResults, err := checkBackup(event, dir, lockmap)
+			cleanup()
+			results = append(results, eventResults...)
+			if err != nil {
+				return results, err
+			}
+		}
+	}
+	return results, nil
+}
+
+// Restore : Bring back media in the given events that is missing, or no longer matches the lock, from backups matching name that can be read back.
+// Backups are tried in order, moving on to the next when a file is not in one (or its copy does not match the lock).
+// Damaged media is moved into the corrupted folder (keeping its structure) rather than replaced. Returns the files that needed restoring, as they were found.
+func Restore(cxt *context.Context, name string, events []string) (lock.Results, error) {
+	restored := lock.Results{}
+	commands, err := readable(cxt, name)
+	if err != nil {
+		return restored, err
+	}
+	failed := 0
+	for _, event := range events {
+		lockmap, err := lock.ReadLockFile(event)
+		if err != nil {
+			return restored, err
+		}
+		results, err := lock.VerifyEvent(event)
+		if err != nil {
+			return restored, err
+		}
+		damaged := lock.Results{}
+		for _, result := range results {
+			if result.Mismatch() {
+				damaged = append(damaged, result)
+			}
+		}
+		restored = append(restored, damaged...)
+
+		// Fetch each backup in turn, and bring back what we can
+		for _, command := range commands {
+			if len(damaged) == 0 {
+				break
+			}
+			dir, cleanup, err := readBack(cxt, command, event)
+			if err != nil {
+				return restored, err
+			}
+			if dir == "" { // Dry run. Cannot look inside the backup
+				for _, result := range damaged {
+					result.Detail = "Restore from backup: " + command.Name
+				}
+				damaged = lock.Results{}
+				break
+			}
+			remaining := lock.Results{}
+			for _, result := range damaged {
+				err = restoreFile(cxt, result, dir, lockmap)
+				if err == errNotBackedUp || err == errBadBackup {
+					result.Detail = fmt.Sprintf("%s (%s)", err, command.Name)
+					remaining = append(remaining, result)
+				} else if err != nil {
+					log.Println("Could not restore:", result.Path, err)
+					result.Detail = err.Error()
+					failed++
+				}
+			}
+			cleanup()
+			damaged = remaining
+		}
+		for _, result := range damaged {
+			log.Println("Could not restore:", result.Path, result.Detail)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return restored, fmt.Errorf("%d file(s) could not be restored from backups matching '%s'", failed, name)
+	}
+	return restored, nil
+}
+
+// restoreFile : Replace a single damaged (or missing) file with its backed up copy in dir, after checking the copy against the lock
+func restoreFile(cxt *context.Context, result *lock.Result, dir string, lockmap lock.LockMap) error {
+	name := filepath.Base(result.Path)
+	source := filepath.Join(dir, name)
+	hash, err := lock.HashFile(source)
+	if os.IsNotExist(err) {
+		return errNotBackedUp
+	} else if err != nil {
+		return err
+	}
+	if hash != lockmap[name].ContentHash["SHA256"] {
+		return errBadBackup
+	}
+
+	// Move damaged media out of the way
+	if result.State != lock.MISSING {
+		relpath, err := filepath.Rel(cxt.Root, result.Path)
+		if err != nil {
+			return err
+		}
+		destPath := sort.UniqueName(filepath.Join(cxt.Root, context.CORRUPTED, relpath))
+		log.Println("Moving:", result.Path, "--->", destPath)
+		if !cxt.Journal.IsDryRun() {
+			if err = os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+				return err
+			}
+		}
+		if err = cxt.Journal.Move(result.Path, destPath); err != nil {
+			return err
+		}
+	}
+
+	// Bring back our copy, and lock it down again
+	log.Println("Restoring:", source, "--->", result.Path)
+	if err = cxt.Journal.CopyVerify(source, result.Path, lock.ContentHash); err != nil {
+		return err
+	}
+	if cxt.Journal.IsDryRun() {
+		return nil
+	}
+	info, err := os.Stat(result.Path)
+	if err != nil {
+		return err
+	}
+	result.Detail = "Restored from backup"
+	return cxt.Journal.Chmod(result.Path, info.Mode().Perm()&0444)
+}
@@ -6,7 +6,10 @@ import (
 	"io/ioutil"
 	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/rs/xid"
 	"gopkg.in/yaml.v2"
@@ -15,12 +18,43 @@ import (
 // SORTED : Default path to file where sorted media goes (before being assigned an event or being renamed/compressed)
 const SORTED = "Sorted"
 
+// SORTLAYOUT : Default template for folders media is sorted into. ie 18-10-22
+const SORTLAYOUT = "{{.YY}}-{{.MM}}-{{.DD}}"
+
+// MIRROR : Backup type copying files into another directory (Dest), without running a command
+const MIRROR = "mirror"
+
+// EVENT : Backup type running the command once for each event, rather than once for the working directory
+const EVENT = "event"
+
 // Command : Structure for a command
 type Command struct {
 	Name    string `yaml:"name"`
 	Command string `yaml:"command"`
+	Type    string `yaml:"type,omitempty"`    // Backups only. Empty runs the command on the working directory, "event" on each event, "mirror" copies files into Dest
+	Dest    string `yaml:"dest,omitempty"`    // Backups only. Where a mirror copies files to. ie /mnt/nas/photos
+	Restore string `yaml:"restore,omitempty"` // Backups only. Command fetching a backed up event ($RELPATH) into $RESTOREPATH, so it can be checked or restored
+}
+
+// SORTEXCLUDE : Default patterns of files left behind when sorting directories. Camera thumbnails, catalogs and system files
+var SORTEXCLUDE = Patterns{"*.thm", "*.ctg", "*.lrv", "thumbs.db", "desktop.ini"}
+
+// SIDECARS : Default patterns of sidecar files. Kept with the media they describe (same name, different extension)
+var SIDECARS = Patterns{"*.xmp", "*.aae"}
+
+// Patterns : File name patterns (case insensitive). ie "*.jpg"
+type Patterns []string
+
+// CameraOffset : Correction for a camera whose clock was set wrong. Matched against the camera make and model in EXIF data
+type CameraOffset struct {
+	Make   string `yaml:"make"`   // Camera make (case insensitive). Empty matches any
+	Model  string `yaml:"model"`  // Camera model (case insensitive). Empty matches any
+	Offset string `yaml:"offset"` // Amount to add to the camera clock. ie "1h", "-30m"
 }
 
+// CameraOffsets : Groups camera offsets together. Facilitates finding offsets by camera
+type CameraOffsets []CameraOffset
+
 // CompressCategory : Groups categories together. Facilitates finding commands by filter
 type CompressCategory []Command
 
@@ -34,6 +68,13 @@ type Config struct {
 	Sorted   string           `yaml:"sorted"`   // Location of folder that contains sorted media (before being assigned an event/compressed)
 	Compress CompressCategory `yaml:"compress"` // Compression commands
 	Backup   BackupCategory   `yaml:"backup"`   // Backup commands
+
+	SortLayout      string        `yaml:"sort_layout"`                // Template for folders (within sorted folder) media is sorted into. ie {{.Year}}/{{.YY}}-{{.MM}}-{{.DD}}
+	SortInclude     Patterns      `yaml:"sort_include,omitempty"`     // Files to bring in when sorting directories. Empty includes everything
+	SortExclude     Patterns      `yaml:"sort_exclude"`               // Files to leave behind when sorting directories. Also skips matching sub-directories
+	Sidecars        Patterns      `yaml:"sidecars"`                   // Sidecar files, kept with the media they describe
+	CameraOffsets   CameraOffsets `yaml:"camera_offsets,omitempty"`   // Corrections for camera clocks, applied when sorting
+	CompressWorkers int           `yaml:"compress_workers,omitempty"` // Number of compression commands to run at once. Defaults to number of CPUs
 }
 
 // NewConfig build barebones data to get started on a new config file
@@ -42,6 +83,9 @@ func NewConfig(location string) *Config {
 	newConfig.ID = xid.New().String()      // Generate random ID
 	newConfig.Location = location          // Nice name for location
 	newConfig.Sorted = SORTED              // Default location for sorted media
+	newConfig.SortLayout = SORTLAYOUT      // Default folder structure for sorted media
+	newConfig.SortExclude = SORTEXCLUDE    // Default junk to leave behind
+	newConfig.Sidecars = SIDECARS          // Default sidecar files
 	newConfig.Compress = CompressCategory{ // Useful default entry to demo structure
 		Command{Name: "*.jpg *.jpeg *.png", Command: `echo "This is an example command that will run on jpg, jpeg, png files."`}}
 	newConfig.Backup = BackupCategory{ // Another useful demo
@@ -76,6 +120,41 @@ func (conf *Config) ValidateConfig() error {
 	if err := validatePath(conf.Sorted); err != nil {
 		return err
 	}
+	if _, err := template.New("sort_layout").Parse(conf.SortLayout); err != nil {
+		return fmt.Errorf("bad sort_layout template: %s", err)
+	}
+	for _, patterns := range []Patterns{conf.SortInclude, conf.SortExclude, conf.Sidecars} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("bad pattern '%s': %s", pattern, err)
+			}
+		}
+	}
+	for _, backup := range conf.Backup {
+		if backup.Name == "status" || backup.Name == "verify" { // Taken by the backup command itself
+			return fmt.Errorf("backup name '%s' is reserved", backup.Name)
+		}
+		switch backup.Type {
+		case "", EVENT:
+		case MIRROR:
+			if strings.TrimSpace(backup.Dest) == "" {
+				return fmt.Errorf("mirror backup '%s' needs a dest", backup.Name)
+			}
+			if dest := strings.TrimSpace(backup.Dest); !strings.HasPrefix(dest, "$") && !path.IsAbs(filepath.ToSlash(dest)) && !filepath.IsAbs(dest) {
+				return fmt.Errorf("mirror backup '%s' needs an absolute dest, outside the project", backup.Name)
+			}
+		default:
+			return fmt.Errorf("unknown backup type '%s' for '%s'", backup.Type, backup.Name)
+		}
+	}
+	for _, cameraOffset := range conf.CameraOffsets {
+		if strings.TrimSpace(cameraOffset.Make) == "" && strings.TrimSpace(cameraOffset.Model) == "" {
+			return fmt.Errorf("camera offset needs a make or model")
+		}
+		if _, err := time.ParseDuration(cameraOffset.Offset); err != nil {
+			return fmt.Errorf("bad camera offset for '%s %s': %s", cameraOffset.Make, cameraOffset.Model, err)
+		}
+	}
 	return nil
 }
 
@@ -93,6 +172,18 @@ func LoadConfig(reader io.Reader) (*Config, error) {
 	if loadedConfig.Sorted == "" { // Set default
 		loadedConfig.Sorted = SORTED
 	}
+	if strings.TrimSpace(loadedConfig.SortLayout) == "" { // Set default
+		loadedConfig.SortLayout = SORTLAYOUT
+	}
+	if loadedConfig.SortExclude == nil { // Set default. Empty list to exclude nothing
+		loadedConfig.SortExclude = SORTEXCLUDE
+	}
+	if loadedConfig.Sidecars == nil { // Set default. Empty list for no sidecars
+		loadedConfig.Sidecars = SIDECARS
+	}
+	if loadedConfig.CompressWorkers <= 0 { // Set default
+		loadedConfig.CompressWorkers = runtime.NumCPU()
+	}
 	return loadedConfig, loadedConfig.ValidateConfig()
 }
 
@@ -129,19 +220,65 @@ func (compress CompressCategory) GetCommand(filename string) string {
 	return ""
 }
 
+// Pattern functionality
+
+// Match : Check if the name of a file (ignoring its path) matches any of the patterns
+func (patterns Patterns) Match(filename string) bool {
+	lowName := strings.ToLower(filepath.Base(filename))
+	for _, pattern := range patterns {
+		match, err := path.Match(strings.ToLower(pattern), lowName)
+		if err != nil { // This will only trigger if pattern is malformed, which validation should catch
+			panic(err)
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// Camera offset functionality
+
+// GetOffset : Get the offset of the first entry (in config order) matching the camera. Zero if none match
+func (offsets CameraOffsets) GetOffset(cameraMake, cameraModel string) time.Duration {
+	for _, cameraOffset := range offsets {
+		if cameraOffset.Make != "" && !strings.EqualFold(strings.TrimSpace(cameraOffset.Make), strings.TrimSpace(cameraMake)) {
+			continue
+		}
+		if cameraOffset.Model != "" && !strings.EqualFold(strings.TrimSpace(cameraOffset.Model), strings.TrimSpace(cameraModel)) {
+			continue
+		}
+		offset, err := time.ParseDuration(cameraOffset.Offset)
+		if err != nil { // This will only trigger if offset is malformed, which validation should catch
+			panic(err)
+		}
+		return offset
+	}
+	return 0
+}
+
 // Backup functionality
 
 // GetCommands : Get all backup commands that match the provided name
 func (backup BackupCategory) GetCommands(name string) []string {
 	commands := []string{}
+	for _, command := range backup.Find(name) {
+		commands = append(commands, command.Command)
+	}
+	return commands
+}
+
+// Find : Get all backup entries that match the provided name
+func (backup BackupCategory) Find(name string) BackupCategory {
+	found := BackupCategory{}
 	for _, command := range backup {
 		match, err := filepath.Match(name, command.Name)
 		if err != nil {
 			panic(err) // Malformed name!
 		}
 		if match {
-			commands = append(commands, command.Command)
+			found = append(found, command)
 		}
 	}
-	return commands
+	return found
 }
@@ -4,7 +4,9 @@ package config
 import (
 	"bytes"
 	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/internetimagery/photos/testutil"
 	"gopkg.in/yaml.v2"
@@ -156,3 +158,137 @@ backup:
 		}
 	}
 }
+
+func TestBackupMirror(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+
+	conf := tu.Must(LoadConfig(bytes.NewReader([]byte("location: test\nbackup:\n- name: nas\n  type: mirror\n  dest: /mnt/nas\n")))).(*Config)
+	if mirror := conf.Backup.Find("nas"); len(mirror) != 1 || mirror[0].Type != MIRROR || mirror[0].Dest != "/mnt/nas" {
+		tu.Fail("Mirror not loaded. Got", mirror)
+	}
+	if _, err := LoadConfig(bytes.NewReader([]byte("location: test\nbackup:\n- name: nas\n  type: mirror\n"))); err == nil {
+		tu.Fail("Allowed mirror without a destination")
+	}
+	if _, err := LoadConfig(bytes.NewReader([]byte("location: test\nbackup:\n- name: nas\n  type: mirror\n  dest: mirror\n"))); err == nil {
+		tu.Fail("Allowed mirror with a relative destination")
+	}
+	if _, err := LoadConfig(bytes.NewReader([]byte("location: test\nbackup:\n- name: nas\n  type: mirror\n  dest: $MIRRORPATH\n"))); err != nil {
+		tu.Fail("Mirror destination from the environment not allowed", err)
+	}
+	if _, err := LoadConfig(bytes.NewReader([]byte("location: test\nbackup:\n- name: nas\n  type: unknown\n"))); err == nil {
+		tu.Fail("Allowed unknown backup type")
+	}
+	if _, err := LoadConfig(bytes.NewReader([]byte("location: test\nbackup:\n- name: b2\n  type: event\n  command: rclone\n"))); err != nil {
+		tu.Fail("Backup run on each event not allowed", err)
+	}
+	for _, name := range []string{"status", "verify"} {
+		if _, err := LoadConfig(bytes.NewReader([]byte("location: test\nbackup:\n- name: " + name + "\n  command: echo\n"))); err == nil {
+			tu.Fail("Allowed reserved backup name", name)
+		}
+	}
+}
+
+func TestCompressWorkers(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+
+	// Test default
+	conf := tu.Must(LoadConfig(bytes.NewReader([]byte("location: test\n")))).(*Config)
+	if expect := runtime.NumCPU(); conf.CompressWorkers != expect {
+		tu.FailE(expect, conf.CompressWorkers)
+	}
+
+	// Test set value
+	conf = tu.Must(LoadConfig(bytes.NewReader([]byte("location: test\ncompress_workers: 3\n")))).(*Config)
+	if expect := 3; conf.CompressWorkers != expect {
+		tu.FailE(expect, conf.CompressWorkers)
+	}
+}
+
+func TestSortLayout(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+
+	// Test default
+	conf := tu.Must(LoadConfig(bytes.NewReader([]byte("location: test\n")))).(*Config)
+	if conf.SortLayout != SORTLAYOUT {
+		tu.FailE(SORTLAYOUT, conf.SortLayout)
+	}
+
+	// Test set value
+	conf = tu.Must(LoadConfig(bytes.NewReader([]byte("location: test\nsort_layout: \"{{.Year}}/{{.MM}}\"\n")))).(*Config)
+	if expect := "{{.Year}}/{{.MM}}"; conf.SortLayout != expect {
+		tu.FailE(expect, conf.SortLayout)
+	}
+
+	// Test broken template
+	if _, err := LoadConfig(bytes.NewReader([]byte("location: test\nsort_layout: \"{{.Year\"\n"))); err == nil {
+		tu.Fail("Allowed broken sort_layout template")
+	}
+}
+
+func TestCameraOffsets(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+
+	testData := `---
+location: test
+camera_offsets:
+-
+    make: Canon
+    model: Canon EOS 5D
+    offset: -1h
+-
+    make: nikon
+    offset: 30m
+`
+	conf := tu.Must(LoadConfig(bytes.NewReader([]byte(testData)))).(*Config)
+
+	tests := map[[2]string]time.Duration{
+		{"Canon", "Canon EOS 5D"}:  -time.Hour,
+		{"CANON ", "canon eos 5d"}: -time.Hour,
+		{"Canon", "Canon EOS 80D"}: 0,
+		{"NIKON", "NIKON D750"}:    30 * time.Minute,
+		{"", ""}:                   0,
+	}
+	for test, expect := range tests {
+		if offset := conf.CameraOffsets.GetOffset(test[0], test[1]); offset != expect {
+			tu.FailE(expect, offset)
+		}
+	}
+
+	// Test bad offsets
+	for _, testData := range []string{
+		"location: test\ncamera_offsets:\n- make: Canon\n  offset: soon\n",
+		"location: test\ncamera_offsets:\n- offset: 1h\n",
+	} {
+		if _, err := LoadConfig(bytes.NewReader([]byte(testData))); err == nil {
+			tu.Fail("Allowed bad camera offset", testData)
+		}
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+
+	// Test defaults, and that an empty list is respected
+	conf := tu.Must(LoadConfig(bytes.NewReader([]byte("location: test\nsidecars: []\n")))).(*Config)
+	if len(conf.SortExclude) != len(SORTEXCLUDE) || len(conf.SortInclude) != 0 || len(conf.Sidecars) != 0 {
+		tu.Fail("Bad default patterns", conf.SortInclude, conf.SortExclude, conf.Sidecars)
+	}
+
+	tests := map[string]bool{
+		"IMG_0001.THM": true,
+		filepath.Join("DCIM", "100CANON", "a.ctg"): true,
+		"Thumbs.db":    true,
+		"IMG_0001.JPG": false,
+		"thm":          false,
+	}
+	for test, expect := range tests {
+		if match := conf.SortExclude.Match(test); match != expect {
+			tu.Fail("Bad match for", test, "Expected:", expect)
+		}
+	}
+
+	// Test bad patterns
+	if _, err := LoadConfig(bytes.NewReader([]byte("location: test\nsort_include: [\"[a-\"]\n"))); err == nil {
+		tu.Fail("Allowed bad pattern")
+	}
+}
@@ -0,0 +1,88 @@
+package confirm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ENV : Environment variable setting how confirmation is handled when no flag is given. "ask", "yes" or "no-input"
+const ENV = "PHOTOS_CONFIRM"
+
+// Confirmation modes
+const (
+	ASK     = "ask"      // Prompt the user
+	YES     = "yes"      // Assume yes, without prompting
+	NOINPUT = "no-input" // Fail instead of prompting
+)
+
+// ErrNoInput : Confirmation was needed, but input was disabled
+var ErrNoInput = errors.New("confirmation needed, but input is disabled. Use --yes to confirm without input")
+
+// Confirm : Ask for confirmation before making changes
+type Confirm struct {
+	Mode   string    // How to confirm. ASK, YES or NOINPUT
+	Input  io.Reader // Where to read answers from. Defaults to stdin
+	Output io.Writer // Where to write prompts to. Defaults to stdout
+}
+
+// NewConfirm : Create confirmation with the given mode. Falling back to the environment variable, and prompting if neither is set
+func NewConfirm(mode string) (*Confirm, error) {
+	if mode == "" {
+		mode = os.Getenv(ENV)
+	}
+	switch mode {
+	case "":
+		mode = ASK
+	case ASK, YES, NOINPUT:
+	default:
+		return nil, fmt.Errorf("unrecognized confirmation mode '%s'. Expected '%s', '%s' or '%s'", mode, ASK, YES, NOINPUT)
+	}
+	return &Confirm{Mode: mode}, nil
+}
+
+// Ask : Ask yes or no
+func (conf *Confirm) Ask() (bool, error) {
+	input, output := conf.Input, conf.Output
+	if input == nil {
+		input = os.Stdin
+	}
+	if output == nil {
+		output = os.Stdout
+	}
+	switch conf.Mode {
+	case YES:
+		fmt.Fprintln(output, "Is this ok? (y|n) : y")
+		return true, nil
+	case NOINPUT:
+		return false, ErrNoInput
+	}
+	fmt.Fprint(output, "Is this ok? (y|n) : ")
+	response, err := readLine(input)
+	if err != nil {
+		return false, err
+	}
+	response = strings.ToLower(strings.TrimSpace(response))
+	return response == "y" || response == "yes", nil
+}
+
+// readLine : Read up to the end of the line. A byte at a time, so nothing past the line is consumed
+func readLine(input io.Reader) (string, error) {
+	line, buf := []byte{}, make([]byte, 1)
+	for {
+		n, err := input.Read(buf)
+		if n > 0 {
+			if buf[0] == '\n' {
+				return string(line), nil
+			}
+			line = append(line, buf[0])
+		}
+		if err == io.EOF {
+			return string(line), nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package confirm
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/internetimagery/photos/testutil"
+)
+
+// errReader : Reader that always fails
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errors.New("broken input") }
+
+func TestAsk(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+
+	answers := map[string]bool{"y\n": true, "YES\n": true, "n\n": false, "\n": false, "anything\n": false, "": false}
+	for input, expect := range answers {
+		conf := &Confirm{Mode: ASK, Input: strings.NewReader(input), Output: ioutil.Discard}
+		if ok := tu.MustFatal(conf.Ask()).(bool); ok != expect {
+			tu.Fail("Unexpected answer to input", input, ok)
+		}
+	}
+
+	// Test only one line is consumed per question
+	input := strings.NewReader("n\ny\n")
+	conf := &Confirm{Mode: ASK, Input: input, Output: ioutil.Discard}
+	if tu.MustFatal(conf.Ask()).(bool) || !tu.MustFatal(conf.Ask()).(bool) {
+		tu.Fail("Answers not read one line at a time")
+	}
+
+	// Test read errors are returned
+	conf = &Confirm{Mode: ASK, Input: errReader{}, Output: ioutil.Discard}
+	if _, err := conf.Ask(); err == nil {
+		tu.Fail("Read error not returned")
+	}
+}
+
+func TestAskNonInteractive(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+
+	// Test yes never reads input
+	conf := &Confirm{Mode: YES, Input: errReader{}, Output: ioutil.Discard}
+	if !tu.MustFatal(conf.Ask()).(bool) {
+		tu.Fail("Yes mode did not confirm")
+	}
+
+	// Test no input fails instead of prompting
+	conf = &Confirm{Mode: NOINPUT, Input: strings.NewReader("y\n"), Output: ioutil.Discard}
+	if _, err := conf.Ask(); err != ErrNoInput {
+		tu.Fail("Expected no input error", err)
+	}
+}
+
+func TestNewConfirm(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+
+	oldEnv, hadEnv := os.LookupEnv(ENV)
+	defer func() {
+		if hadEnv {
+			os.Setenv(ENV, oldEnv)
+		} else {
+			os.Unsetenv(ENV)
+		}
+	}()
+
+	// Test default is to prompt
+	os.Unsetenv(ENV)
+	if conf := tu.MustFatal(NewConfirm("")).(*Confirm); conf.Mode != ASK {
+		tu.Fail("Expected to ask by default", conf.Mode)
+	}
+
+	// Test environment is used, unless mode is given directly
+	os.Setenv(ENV, YES)
+	if conf := tu.MustFatal(NewConfirm("")).(*Confirm); conf.Mode != YES {
+		tu.Fail("Environment variable not used", conf.Mode)
+	}
+	if conf := tu.MustFatal(NewConfirm(NOINPUT)).(*Confirm); conf.Mode != NOINPUT {
+		tu.Fail("Given mode did not override environment", conf.Mode)
+	}
+
+	// Test bad modes are rejected
+	os.Setenv(ENV, "maybe")
+	if _, err := NewConfirm(""); err == nil {
+		tu.Fail("Allowed bad confirmation mode")
+	}
+}
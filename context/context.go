@@ -2,6 +2,7 @@ package context
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -9,11 +10,21 @@ import (
 
 	"github.com/google/shlex"
 	"github.com/internetimagery/photos/config"
+	"github.com/internetimagery/photos/journal"
 )
 
 // ROOTCONF : name of config file that marks the root of the project (as well as important information)
 const ROOTCONF = "photos-config.yaml"
 
+// SOURCEDIR : Folder (within an event) where rename keeps originals for manual checking
+const SOURCEDIR = "Source Media - Please check before removing"
+
+// QUARANTINE : Folder (relative to project root) where duplicates are moved for manual checking
+const QUARANTINE = "Duplicates - Please check before removing"
+
+// CORRUPTED : Folder (relative to project root) where damaged media is moved when restored from backup, for manual checking
+const CORRUPTED = "Corrupted - Please check before removing"
+
 // Context : Collect and encapsulate information about project
 type Context struct {
 	Root       string            // Path to base of repository (location of config)
@@ -21,6 +32,8 @@ type Context struct {
 	SortDir    string    // Sorted files directory
 	Env        map[string]string // Representation of the environment
 	Config     *config.Config    // Configuration information
+	Journal    *journal.Journal  // Record of changes made to files
+	Output     io.Writer         // Where commands print their output. Defaults to stdout
 }
 
 // NewContext : Create a new context, gathering information
@@ -69,9 +82,20 @@ func NewContext(workingDir string) (*Context, error) {
 		WorkingDir: workingDir,
 		SortDir: sortDir,
 		Config: conf,
+		Journal: journal.NewJournal(currentRoot),
 		Env: env}, nil
 }
 
+// Copy : Make a copy of the context, with its own environment. Useful for running commands side by side.
+func (cxt *Context) Copy() *Context {
+	newCxt := *cxt
+	newCxt.Env = make(map[string]string, len(cxt.Env))
+	for key, value := range cxt.Env {
+		newCxt.Env[key] = value
+	}
+	return &newCxt
+}
+
 // expandEnv : Expand environment variables with those from context. Make safe the backslashes also!
 func (cxt *Context) expandEnv(name string) string {
 	return strings.Replace(cxt.Env[name], `\`, `\\`, -1)
@@ -95,11 +119,50 @@ func (cxt *Context) PrepCommand(commandRaw string) (*exec.Cmd, error) {
 	}
 	command := exec.Command(commandParts[0], commandParts[1:]...)
 	command.Stdout = os.Stdout
+	if cxt.Output != nil {
+		command.Stdout = cxt.Output
+	}
 	command.Stderr = os.Stderr
 	command.Env = cxt.contractEnv()
 	return command, nil
 }
 
+// WalkEvents : Visit every directory (event) within the project, skipping the sorted directory, hidden folders
+// and media set aside to be checked over by hand (originals kept by rename, duplicates and damaged media)
+func (cxt *Context) WalkEvents(visit func(eventPath string) error) error {
+	return cxt.WalkEventsIn(cxt.Root, visit)
+}
+
+// WalkEventsIn : Visit every directory (event) within directory, skipping the same folders as WalkEvents
+func (cxt *Context) WalkEventsIn(directory string, visit func(eventPath string) error) error {
+	skip := map[string]struct{}{
+		cxt.SortDir:                         {},
+		filepath.Join(cxt.Root, QUARANTINE): {},
+		filepath.Join(cxt.Root, CORRUPTED):  {},
+	}
+	return filepath.Walk(directory, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if _, ok := skip[filename]; ok {
+			return filepath.SkipDir
+		}
+		if filename != directory && (strings.HasPrefix(info.Name(), ".") || info.Name() == SOURCEDIR) {
+			return filepath.SkipDir
+		}
+		return visit(filename)
+	})
+}
+
+// Within : Check if filename is the directory, or somewhere inside it. Both absolute
+func Within(directory, filename string) bool {
+	relpath, err := filepath.Rel(directory, filename)
+	return err == nil && relpath != ".." && !strings.HasPrefix(relpath, ".."+string(filepath.Separator))
+}
+
 // AbsPath : Take user provided path, and make it absolute, relative to context working dir (same as filepath.Abs)
 func (cxt *Context) AbsPath(filename string) string {
 	filename = filepath.FromSlash(strings.TrimSpace(filename)) // First ensure input is relevant to os
@@ -59,6 +59,25 @@ func TestContextPrepCommand(t *testing.T) {
 	}
 }
 
+func TestContextCopy(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+
+	cxt := &Context{Root: "/root", Env: map[string]string{"TESTENV": "VALUE"}}
+	newCxt := cxt.Copy()
+	newCxt.Env["TESTENV"] = "OTHER"
+	newCxt.Env["NEWENV"] = "NEW"
+
+	if newCxt.Root != cxt.Root {
+		tu.FailE(cxt.Root, newCxt.Root)
+	}
+	if cxt.Env["TESTENV"] != "VALUE" {
+		tu.FailE("VALUE", cxt.Env["TESTENV"])
+	}
+	if _, ok := cxt.Env["NEWENV"]; ok {
+		tu.Fail("Environment shared with copy")
+	}
+}
+
 func TestContextAbsPath(t *testing.T) {
 	tu := testutil.NewTestUtil(t)
 	cwd, _ := os.Getwd()
@@ -77,3 +96,58 @@ func TestContextAbsPath(t *testing.T) {
 		tu.FailE(expect, cxt.AbsPath("four/../../five"))
 	}
 }
+
+func TestWithin(t *testing.T) {
+	root := filepath.Join(string(filepath.Separator), "one", "two")
+	for filename, expect := range map[string]bool{
+		root:                                  true,
+		filepath.Join(root, "three"):          true,
+		filepath.Join(root, "..two", "three"): true,
+		filepath.Join(root, ".."):             false,
+		filepath.Join(root, "..", "three"):    false,
+		filepath.Join(root+"three", "four"):   false,
+	} {
+		if Within(root, filename) != expect {
+			t.Log("Within", root, filename, "expected", expect)
+			t.Fail()
+		}
+	}
+}
+
+func TestContextWalkEvents(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	cxt := tu.MustFatal(NewContext(tu.Dir)).(*Context)
+
+	visited := map[string]bool{}
+	tu.Must(cxt.WalkEvents(func(eventPath string) error {
+		visited[eventPath] = true
+		return nil
+	}))
+
+	for _, expect := range []string{
+		tu.Dir,
+		filepath.Join(tu.Dir, "event01"),
+		filepath.Join(tu.Dir, "2018"),
+		filepath.Join(tu.Dir, "2018", "event02"),
+	} {
+		if !visited[expect] {
+			tu.Fail("Did not visit", expect)
+		}
+	}
+	for _, expect := range []string{
+		filepath.Join(tu.Dir, "Sorted"),
+		filepath.Join(tu.Dir, "Sorted", "18-10-10"),
+		filepath.Join(tu.Dir, ".hidden"),
+		filepath.Join(tu.Dir, QUARANTINE),
+		filepath.Join(tu.Dir, QUARANTINE, "event01"),
+		filepath.Join(tu.Dir, CORRUPTED),
+		filepath.Join(tu.Dir, CORRUPTED, "event01"),
+		filepath.Join(tu.Dir, "event01", SOURCEDIR),
+	} {
+		if visited[expect] {
+			tu.Fail("Visited skipped directory", expect)
+		}
+	}
+}
@@ -5,10 +5,47 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+
+	"github.com/internetimagery/photos/progress"
 )
 
+// Hasher : Generate a hash from content, to compare a copy against its source (ie lock.GenerateContentHash)
+type Hasher func(handle io.Reader) (string, error)
+
+// hashFile : Hash the contents of a file
+func hashFile(filename string, hasher Hasher) (string, error) {
+	handle, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer handle.Close()
+	return hasher(handle)
+}
+
+// verify : Check the copy has the same content as its source
+func verify(source, destination string, hasher Hasher) error {
+	sourceHash, err := hashFile(source, hasher)
+	if err != nil {
+		return err
+	}
+	destinationHash, err := hashFile(destination, hasher)
+	if err != nil {
+		return err
+	}
+	if sourceHash != destinationHash {
+		return fmt.Errorf("Copy does not match source '%s' != '%s'", source, destination)
+	}
+	return nil
+}
+
 // File : Copy a file. Can be used in serial or goroutine
 func File(source, destination string) chan error {
+	return FileVerify(source, destination, nil)
+}
+
+// FileVerify : Copy a file, then check the copy matches the source by hashing both. The copy is removed if it does not match.
+// A nil hasher skips the check, same as File.
+func FileVerify(source, destination string, hasher Hasher) chan error {
 	done := make(chan error)
 	go func() {
 		var err error
@@ -43,6 +80,12 @@ func File(source, destination string) chan error {
 			destinationHandle.Close() // Error not handled, argh
 			return
 		}
+		if hasher != nil { // Ensure what we check is what landed on disk
+			if err = destinationHandle.Sync(); err != nil {
+				destinationHandle.Close()
+				return
+			}
+		}
 		if err = destinationHandle.Close(); err != nil {
 			return
 		}
@@ -52,6 +95,11 @@ func File(source, destination string) chan error {
 			return
 		}
 
+		// Check the copy made it across intact
+		if hasher != nil {
+			err = verify(source, destination, hasher)
+		}
+
 		// // Last minute permissions change if on windows
 		// if runtime.GOOS == "windows" {
 		// 	err = acl.Chmod(destinationHandle.Name(), perm)
@@ -69,8 +117,16 @@ func File(source, destination string) chan error {
 // 	return <-File(sourceDir, destinationDir)
 // }
 
-// Tree : Copy files and directories recursively
+// Tree : Copy files and directories recursively, reporting progress as files are copied
 func Tree(sourceDir, destinationDir string) error {
+	report := progress.NewReporter("copy")
+	defer report.Close()
+	return TreeVerify(sourceDir, destinationDir, nil, report)
+}
+
+// TreeVerify : Copy files and directories recursively, checking each file copied matches its source (see FileVerify).
+// Nothing is left behind if any file does not match. Each file is reported as it finishes copying (report can be nil).
+func TreeVerify(sourceDir, destinationDir string, hasher Hasher, report *progress.Reporter) error {
 	sourceInfo, err := os.Stat(sourceDir)
 	if err != nil {
 		return err
@@ -131,7 +187,15 @@ func Tree(sourceDir, destinationDir string) error {
 			}
 			job <- nil
 		} else {
-			job = File(sourcePath, destPath)
+			report.Expect(1, info.Size())
+			copied := FileVerify(sourcePath, destPath, hasher)
+			go func() {
+				err := <-copied
+				if err == nil {
+					report.Done(sourcePath, info.Size())
+				}
+				job <- err
+			}()
 		}
 		jobs = append(jobs, &Media{
 			Job:        job,
@@ -1,12 +1,21 @@
 package copy
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/internetimagery/photos/progress"
 )
 
 type TestEnv struct {
@@ -56,6 +65,25 @@ func (env *TestEnv) Join(parts ...string) string {
 	return filepath.Join(append([]string{env.Dir}, parts...)...)
 }
 
+func hashContent(handle io.Reader) (string, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, handle); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// Pretend every read comes back different, like a flaky card reader
+func hashFlaky() Hasher {
+	count, lock := 0, new(sync.Mutex)
+	return func(handle io.Reader) (string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		count++
+		return fmt.Sprint(count), nil
+	}
+}
+
 ////////////////////////////// TESTS /////////////////////////////
 
 func TestCopyFile(t *testing.T) {
@@ -168,6 +196,40 @@ func TestCopyFileMissing(t *testing.T) {
 	}
 }
 
+func TestCopyFileVerify(t *testing.T) {
+
+	tu := NewTestEnv(t)
+	defer tu.Close()
+
+	sourceFile, _ := tu.MkFile(tu.Join("testfile1.txt"), "Hello", 0644, nil)
+	destFile := tu.Join("testfile2.txt")
+
+	// Test matching copy passes
+	if err := <-FileVerify(sourceFile, destFile, hashContent); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+	if _, err := os.Stat(destFile); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+
+	// Test mismatched copy fails, and is cleaned up
+	destFile = tu.Join("testfile3.txt")
+	if err := <-FileVerify(sourceFile, destFile, hashFlaky()); err == nil {
+		t.Log("No error with mismatched copy")
+		t.Fail()
+	}
+	if _, err := os.Stat(destFile); !os.IsNotExist(err) {
+		t.Log("Mismatched copy not cleaned up", destFile)
+		t.Fail()
+	}
+	if _, err := os.Stat(sourceFile); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+}
+
 func TestTree(t *testing.T) {
 
 	tu := NewTestEnv(t)
@@ -196,6 +258,76 @@ func TestTree(t *testing.T) {
 	}
 }
 
+func TestTreeVerify(t *testing.T) {
+
+	tu := NewTestEnv(t)
+	defer tu.Close()
+
+	sourceDir := tu.Join("root1")
+
+	tu.MkFile(tu.Join("root1", "test1.txt"), "one", 0644, nil)
+	tu.MkFile(tu.Join("root1", "subdir", "test2.txt"), "two", 0644, nil)
+
+	// Test matching copies pass
+	if err := TreeVerify(sourceDir, tu.Join("root2"), hashContent, nil); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+	if _, err := os.Stat(tu.Join("root2", "subdir", "test2.txt")); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+
+	// Test mismatched copies fail, leaving nothing behind
+	if err := TreeVerify(sourceDir, tu.Join("root3"), hashFlaky(), nil); err == nil {
+		t.Log("No error with mismatched copies")
+		t.Fail()
+	}
+	if _, err := os.Stat(tu.Join("root3")); !os.IsNotExist(err) {
+		t.Log("Mismatched copies not cleaned up")
+		t.Fail()
+	}
+}
+
+func TestTreeVerifyProgress(t *testing.T) {
+
+	tu := NewTestEnv(t)
+	defer tu.Close()
+
+	sourceDir := tu.Join("root1")
+
+	tu.MkFile(tu.Join("root1", "test1.txt"), "one", 0644, nil)
+	tu.MkFile(tu.Join("root1", "subdir", "test2.txt"), "two", 0644, nil)
+
+	// Log progress rather than drawing it
+	handle, err := os.Create(tu.Join("output.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	defer func(output *os.File) { progress.Output = output }(progress.Output)
+	progress.Output = handle
+	logs := new(bytes.Buffer)
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(logs)
+
+	// Test each file copied is reported
+	report := progress.NewReporter("copy")
+	if err := TreeVerify(sourceDir, tu.Join("root2"), hashContent, report); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+	report.Close()
+	if count := strings.Count(logs.String(), "Progress: copy files="); count != 2 {
+		t.Log("Expected two files reported. Got", logs.String())
+		t.Fail()
+	}
+	if !strings.Contains(logs.String(), "files=2/2 bytes=6/6") {
+		t.Log("Expected all files to be done. Got", logs.String())
+		t.Fail()
+	}
+}
+
 func TestTreeExistingDir(t *testing.T) {
 
 	tu := NewTestEnv(t)
@@ -0,0 +1,53 @@
+package copy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"os"
+)
+
+// rename : Swappable for testing moves between filesystems
+var rename = os.Rename
+
+// contentHash : Hash content to check a moved file made it across intact
+func contentHash(handle io.Reader) (string, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, handle); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// isCrossDevice : Check if a rename failed because the files are on different filesystems
+func isCrossDevice(err error) bool {
+	linkErr, ok := err.(*os.LinkError)
+	return ok && linkErr.Err == errCrossDevice
+}
+
+// Move : Move (rename) a file. If the destination is on another filesystem (ie from a camera card), fall back to
+// copying the file across, checking it matches, then removing the source. Modification time and permissions are kept.
+func Move(source, destination string) error {
+	err := rename(source, destination)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+
+	// Copy the file, making sure it is intact and on disk before removing the source
+	sourceInfo, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if err = <-FileVerify(source, destination, contentHash); err != nil {
+		return err
+	}
+	if err = os.Chmod(destination, sourceInfo.Mode().Perm()); err != nil { // In case umask got in the way
+		os.Remove(destination)
+		return err
+	}
+	if err = os.Remove(source); err != nil { // Could not finish the move. Put things back how they were
+		os.Remove(destination)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package copy
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestMove(t *testing.T) {
+	tu := NewTestEnv(t)
+	defer tu.Close()
+
+	sourceFile, _ := tu.MkFile(tu.Join("testfile1.txt"), "Hello", 0644, nil)
+	destFile := tu.Join("testfile2.txt")
+
+	if err := Move(sourceFile, destFile); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+	if _, err := os.Stat(sourceFile); !os.IsNotExist(err) {
+		t.Log("Source file still exists")
+		t.Fail()
+	}
+	if _, err := os.Stat(destFile); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+}
+
+func TestMoveCrossDevice(t *testing.T) {
+	tu := NewTestEnv(t)
+	defer tu.Close()
+
+	// Pretend every file lives on a different filesystem
+	defer func(original func(string, string) error) { rename = original }(rename)
+	rename = func(source, destination string) error {
+		return &os.LinkError{Op: "rename", Old: source, New: destination, Err: errCrossDevice}
+	}
+
+	perms := os.FileMode(0640)
+	modtime := time.Date(2018, 10, 10, 0, 0, 0, 0, time.Local)
+	sourceFile, _ := tu.MkFile(tu.Join("testfile1.txt"), "Hello", perms, &modtime)
+	destFile := tu.Join("testfile2.txt")
+
+	// Test file is copied across, and the source removed
+	if err := Move(sourceFile, destFile); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if _, err := os.Stat(sourceFile); !os.IsNotExist(err) {
+		t.Log("Source file still exists")
+		t.Fail()
+	}
+	destInfo, err := os.Stat(destFile)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if data, err := ioutil.ReadFile(destFile); err != nil || string(data) != "Hello" {
+		t.Log("File contents did not make it across", err)
+		t.Fail()
+	}
+	if !destInfo.ModTime().Equal(modtime) {
+		t.Log("Expected", modtime)
+		t.Log("Got", destInfo.ModTime())
+		t.Fail()
+	}
+	if runtime.GOOS != "windows" && destInfo.Mode().Perm() != perms {
+		t.Log("Expected", perms)
+		t.Log("Got", destInfo.Mode().Perm())
+		t.Fail()
+	}
+
+	// Test moving onto an existing file fails, leaving both alone
+	sourceFile, _ = tu.MkFile(tu.Join("testfile3.txt"), "Hi", 0644, nil)
+	if err := Move(sourceFile, destFile); !os.IsExist(err) {
+		t.Log("Expected existing file error. Got", err)
+		t.Fail()
+	}
+	if _, err := os.Stat(sourceFile); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+	if data, err := ioutil.ReadFile(destFile); err != nil || string(data) != "Hello" {
+		t.Log("Existing file was changed", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package copy
+
+import "syscall"
+
+// errCrossDevice : Error given when renaming a file onto a different filesystem
+var errCrossDevice error = syscall.EXDEV
@@ -0,0 +1,6 @@
+package copy
+
+import "syscall"
+
+// errCrossDevice : Error given when renaming a file onto a different drive (ERROR_NOT_SAME_DEVICE)
+var errCrossDevice error = syscall.Errno(17)
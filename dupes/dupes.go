@@ -0,0 +1,210 @@
+package dupes
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	gosort "sort"
+
+	"github.com/internetimagery/photos/context"
+	"github.com/internetimagery/photos/lock"
+	"github.com/internetimagery/photos/sort"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// THRESHOLD : Default distance between perceptual hashes to consider images similar
+const THRESHOLD = 4
+
+// Group : Collection of media that look to be duplicates of one another
+type Group struct {
+	Exact      bool     `yaml:"exact"`      // All media has the same content
+	Keep       string   `yaml:"keep"`       // Media chosen as the one to keep (relative to root)
+	Duplicates []string `yaml:"duplicates"` // Remaining media (relative to root)
+}
+
+// Report : All duplicate groups found within a project
+type Report []*Group
+
+// Save : Save report data!
+func (report Report) Save(handle io.Writer) error {
+	data, err := yaml.Marshal(report)
+	if err != nil {
+		return err
+	}
+	_, err = handle.Write(data)
+	return err
+}
+
+// item : Locked media and its snapshot
+type item struct {
+	path  string
+	sshot *lock.Snapshot
+}
+
+// collectItems : Grab all locked media across the project
+func collectItems(cxt *context.Context) ([]*item, error) {
+	items := []*item{}
+	err := cxt.WalkEvents(func(eventPath string) error {
+		lockmap, err := lock.ReadLockFile(eventPath)
+		if os.IsNotExist(err) { // Not locked, nothing to compare
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for basename, sshot := range lockmap {
+			filename := filepath.Join(eventPath, basename)
+			if _, err := os.Stat(filename); os.IsNotExist(err) { // Removed since locking. Ignore it
+				continue
+			} else if err != nil {
+				return err
+			}
+			items = append(items, &item{path: filename, sshot: sshot})
+		}
+		return nil
+	})
+	gosort.Slice(items, func(i, j int) bool { return items[i].path < items[j].path })
+	return items, err
+}
+
+// FindDuplicates : Look through locked events in the project for media that shares content, or looks similar within threshold
+func FindDuplicates(cxt *context.Context, threshold int) (Report, error) {
+	items, err := collectItems(cxt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Link up matching items into groups. Each item points to its parent, root items point to themselves
+	parents := make([]int, len(items))
+	for i := range parents {
+		parents[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parents[i] != i {
+			parents[i] = find(parents[i])
+		}
+		return parents[i]
+	}
+	for i := range items {
+		for j := i + 1; j < len(items); j++ {
+			if find(i) == find(j) {
+				continue
+			}
+			chash1, chash2 := items[i].sshot.ContentHash["SHA256"], items[j].sshot.ContentHash["SHA256"] // SHA256 hardcoded for now
+			if chash1 != "" && chash1 == chash2 {
+				parents[find(j)] = find(i)
+				continue
+			}
+			phash1, phash2 := items[i].sshot.PerceptualHash["average"], items[j].sshot.PerceptualHash["average"] // average hardcoded for now
+			if phash1 == "" || phash2 == "" {
+				continue
+			}
+			similar, err := lock.IsSimilarPerceptualHash(phash1, phash2, threshold)
+			if err != nil {
+				return nil, err
+			}
+			if similar {
+				parents[find(j)] = find(i)
+			}
+		}
+	}
+
+	// Gather up our groups
+	groups := map[int][]*item{}
+	order := []int{}
+	for i, itm := range items {
+		root := find(i)
+		if _, ok := groups[root]; !ok {
+			order = append(order, root)
+		}
+		groups[root] = append(groups[root], itm)
+	}
+
+	report := Report{}
+	for _, root := range order {
+		members := groups[root]
+		if len(members) < 2 {
+			continue
+		}
+		// Keep the largest (assumed best quality) media. Earliest path wins a tie
+		keep := members[0]
+		exact := true
+		for _, member := range members[1:] {
+			if member.sshot.Size > keep.sshot.Size {
+				keep = member
+			}
+			if member.sshot.ContentHash["SHA256"] != members[0].sshot.ContentHash["SHA256"] {
+				exact = false
+			}
+		}
+		group := &Group{Exact: exact, Keep: relPath(cxt, keep.path)}
+		for _, member := range members {
+			if member != keep {
+				group.Duplicates = append(group.Duplicates, relPath(cxt, member.path))
+			}
+		}
+		report = append(report, group)
+	}
+	return report, nil
+}
+
+// relPath : Make path relative to project root, in slash form
+func relPath(cxt *context.Context, filename string) string {
+	relpath, err := filepath.Rel(cxt.Root, filename)
+	if err != nil {
+		panic(err) // Paths all come from within the project. This should never fail!
+	}
+	return filepath.ToSlash(relpath)
+}
+
+// Quarantine : Move duplicate media into the quarantine folder (keeping their structure), and out of their events lockfile
+func Quarantine(cxt *context.Context, report Report) error {
+	quarantineDir := filepath.Join(cxt.Root, context.QUARANTINE)
+	for _, group := range report {
+		for _, duplicate := range group.Duplicates {
+			sourcePath := filepath.Join(cxt.Root, filepath.FromSlash(duplicate))
+			destPath := filepath.Join(quarantineDir, filepath.FromSlash(duplicate))
+			destPath = sort.UniqueName(destPath)
+			log.Println("Moving:", sourcePath, "--->", destPath)
+			if cxt.Journal.IsDryRun() {
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+				return err
+			}
+			if err := cxt.Journal.Move(sourcePath, destPath); err != nil {
+				return err
+			}
+
+			// Drop the media from the lock, so the event does not report it missing
+			eventPath := filepath.Dir(sourcePath)
+			lockmap, err := lock.ReadLockFile(eventPath)
+			if err != nil {
+				return err
+			}
+			delete(lockmap, filepath.Base(sourcePath))
+			if err = cxt.Journal.Keep(filepath.Join(eventPath, lock.LOCKFILENAME)); err != nil {
+				return err
+			}
+			if err = lock.WriteLockFile(eventPath, lockmap); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// String : Human readable report
+func (group *Group) String() string {
+	kind := "Similar"
+	if group.Exact {
+		kind = "Exact"
+	}
+	text := fmt.Sprintf("%s duplicates of '%s':", kind, group.Keep)
+	for _, duplicate := range group.Duplicates {
+		text += fmt.Sprintf("\n    %s", duplicate)
+	}
+	return text
+}
@@ -0,0 +1,70 @@
+package dupes
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/internetimagery/photos/context"
+	"github.com/internetimagery/photos/lock"
+	"github.com/internetimagery/photos/testutil"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	cxt := tu.MustFatal(context.NewContext(tu.Dir)).(*context.Context)
+
+	// Test exact and similar media are grouped
+	report := tu.MustFatal(FindDuplicates(cxt, THRESHOLD)).(Report)
+	if len(report) != 2 {
+		tu.FailNow("Expected two groups", report)
+	}
+	if group := report[0]; !group.Exact || group.Keep != "event01/event01_001.txt" || len(group.Duplicates) != 1 || group.Duplicates[0] != "event02/event02_001.txt" {
+		tu.Fail("Bad exact group", group)
+	}
+	if group := report[1]; group.Exact || group.Keep != "event01/event01_002.jpg" || len(group.Duplicates) != 1 || group.Duplicates[0] != "event02/event02_002.jpg" {
+		tu.Fail("Bad similar group", group)
+	}
+
+	// Test zero threshold only picks up exact matches
+	report = tu.MustFatal(FindDuplicates(cxt, 0)).(Report)
+	if len(report) != 1 || !report[0].Exact {
+		tu.Fail("Expected only exact group", report)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	cxt := tu.MustFatal(context.NewContext(tu.Dir)).(*context.Context)
+
+	report := tu.MustFatal(FindDuplicates(cxt, THRESHOLD)).(Report)
+	tu.Must(Quarantine(cxt, report))
+
+	tu.AssertExists(
+		filepath.Join(tu.Dir, "event01", "event01_001.txt"),
+		filepath.Join(tu.Dir, "event01", "event01_002.jpg"),
+		filepath.Join(tu.Dir, context.QUARANTINE, "event02", "event02_001.txt"),
+		filepath.Join(tu.Dir, context.QUARANTINE, "event02", "event02_002.jpg"),
+	)
+	tu.AssertNotExists(
+		filepath.Join(tu.Dir, "event02", "event02_001.txt"),
+		filepath.Join(tu.Dir, "event02", "event02_002.jpg"),
+	)
+
+	// Moved media should no longer be in the lock
+	lockmap := tu.MustFatal(lock.ReadLockFile(filepath.Join(tu.Dir, "event02"))).(lock.LockMap)
+	if _, ok := lockmap["event02_001.txt"]; ok {
+		tu.Fail("Quarantined media still in lockfile")
+	}
+	if _, ok := lockmap["event02_003.jpg"]; !ok {
+		tu.Fail("Unrelated media removed from lockfile")
+	}
+
+	// Quarantined media should not be picked up again
+	if report = tu.MustFatal(FindDuplicates(cxt, THRESHOLD)).(Report); len(report) != 0 {
+		tu.Fail("Duplicates remain after quarantine", report)
+	}
+}
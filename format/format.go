@@ -127,3 +127,52 @@ func GetMediaFromDirectory(dirPath string) ([]*Media, error) {
 	}
 	return mediaList, nil
 }
+
+// GroupMedia : Collect media that belongs together, such as a photo and its sidecar (IMG_01.JPG, IMG_01.xmp or IMG_01.JPG.xmp) or a RAW+JPEG pair.
+// Formatted media is grouped by its index, the rest by name (ignoring extension). Expects media from a single directory, in order.
+func GroupMedia(mediaList []*Media) [][]*Media {
+	// Names (lowercase, no extension) each file would group by, so IMG_01.JPG.xmp can find IMG_01.JPG
+	fullNames := map[string]string{}
+	for _, media := range mediaList {
+		name := strings.ToLower(filepath.Base(media.Path))
+		fullNames[name] = name[:len(name)-len(filepath.Ext(name))]
+	}
+
+	groups := [][]*Media{}
+	lookup := map[string]int{}
+	for _, media := range mediaList {
+		var key string
+		if media.Index > 0 {
+			key = fmt.Sprintf("%s_%d", media.Event, media.Index)
+		} else {
+			name := strings.ToLower(filepath.Base(media.Path))
+			key = name[:len(name)-len(filepath.Ext(name))]
+			if pairName, ok := fullNames[key]; ok {
+				key = pairName
+			}
+			key = "." + key // Keep clear of formatted keys
+		}
+		// Members cannot share an extension, they would end up with the same name
+		for i := 1; ; i++ {
+			index, ok := lookup[key]
+			if !ok {
+				lookup[key] = len(groups)
+				groups = append(groups, []*Media{media})
+				break
+			}
+			clash := false
+			for _, member := range groups[index] {
+				if strings.EqualFold(member.Ext, media.Ext) {
+					clash = true
+					break
+				}
+			}
+			if !clash {
+				groups[index] = append(groups[index], media)
+				break
+			}
+			key = fmt.Sprintf("%s#%d", strings.SplitN(key, "#", 2)[0], i)
+		}
+	}
+	return groups
+}
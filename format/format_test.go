@@ -128,3 +128,33 @@ func TestIsUsable(t *testing.T) {
 		tu.Fail("Failed on unusable path")
 	}
 }
+
+func TestGroupMedia(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	event := filepath.Join(tu.Dir, "event01")
+	mediaList := tu.Must(GetMediaFromDirectory(event)).([]*Media)
+
+	expect := [][]string{
+		[]string{"IMG_0002.CR2", "IMG_0002.JPG", "IMG_0002.xmp"},
+		[]string{"IMG_0003.JPG", "IMG_0003.JPG.xmp"},
+		[]string{"IMG_0003.xmp"}, // Clashes with IMG_0003.JPG.xmp
+		[]string{"event01_001.jpg", "event01_001.xmp"},
+		[]string{"event01_001[one].jpg"}, // Clashes with event01_001.jpg
+		[]string{"notes.txt"},
+	}
+	groups := GroupMedia(mediaList)
+	if len(groups) != len(expect) {
+		tu.FailE(len(expect), len(groups))
+	}
+	for i := 0; i < len(groups) && i < len(expect); i++ {
+		names := []string{}
+		for _, media := range groups[i] {
+			names = append(names, filepath.Base(media.Path))
+		}
+		if strings.Join(names, ",") != strings.Join(expect[i], ",") {
+			tu.FailE(expect[i], names)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package journal
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/internetimagery/photos/copy"
+	"github.com/rs/xid"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// JOURNALFILE : Name of file (at the project root) recording changes made to files
+const JOURNALFILE = "photos-journal.yaml"
+
+// KEEPDIR : Hidden folder (at the project root) holding copies of files replaced in place, so undo can put them back
+const KEEPDIR = ".photos-journal"
+
+// Action types
+const (
+	MOVE   = "move"   // File moved from Source to Dest
+	COPY   = "copy"   // File copied from Source to Dest
+	CREATE = "create" // File created at Dest
+	CHMOD  = "chmod"  // File at Dest permissions changed. Previous permissions stored in Mode
+	MKDIR  = "mkdir"  // Directory created at Dest
+	KEEP   = "keep"   // File at Dest about to be replaced. Previous version kept at Source
+)
+
+// Action : Record of a single change to the filesystem
+type Action struct {
+	Transaction string      `yaml:"transaction" json:"transaction"`           // ID grouping actions performed by one command
+	Command     string      `yaml:"command" json:"command"`                   // Command that performed the action
+	Time        time.Time   `yaml:"time" json:"time"`                         // Time action was performed
+	Type        string      `yaml:"type" json:"type"`                         // Type of action performed
+	Source      string      `yaml:"source,omitempty" json:"source,omitempty"` // Where file came from (if relevant)
+	Dest        string      `yaml:"dest" json:"dest"`                         // File that was changed
+	Mode        os.FileMode `yaml:"mode,omitempty" json:"mode,omitempty"`     // Previous permissions (if relevant)
+}
+
+// Transaction : Group of actions performed by one command. Undone as a unit
+type Transaction struct {
+	ID      string    `json:"id"`
+	Command string    `json:"command"`
+	Time    time.Time `json:"time"`
+	Actions []*Action `json:"actions"`
+}
+
+// Journal : Perform changes to files, keeping a record of them so they can be undone.
+// A nil Journal is valid, and performs changes without recording them.
+type Journal struct {
+	Path        string // Path to journal file
+	DryRun      bool   // Skip making changes (and recording them)
+	transaction string
+	command     string
+	lock        sync.Mutex
+}
+
+// NewJournal : Create a journal writing to the journal file in the project root
+func NewJournal(root string) *Journal {
+	return &Journal{Path: filepath.Join(root, JOURNALFILE), transaction: xid.New().String()}
+}
+
+// Begin : Start a new transaction. Following actions are recorded under the given command
+func (journ *Journal) Begin(command string) {
+	if journ == nil {
+		return
+	}
+	journ.lock.Lock()
+	defer journ.lock.Unlock()
+	journ.transaction = xid.New().String()
+	journ.command = command
+}
+
+// IsDryRun : Check if changes are to be skipped
+func (journ *Journal) IsDryRun() bool {
+	return journ != nil && journ.DryRun
+}
+
+// record : Append an action to the journal file
+func (journ *Journal) record(action *Action) error {
+	if journ == nil {
+		return nil
+	}
+	journ.lock.Lock()
+	defer journ.lock.Unlock()
+	action.Transaction = journ.transaction
+	action.Command = journ.command
+	action.Time = time.Now()
+	data, err := yaml.Marshal(action)
+	if err != nil {
+		return err
+	}
+	handle, err := os.OpenFile(journ.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = handle.Write(append([]byte("---\n"), data...)); err != nil {
+		handle.Close()
+		return err
+	}
+	return handle.Close()
+}
+
+// Move : Move (rename) file and record it. Works across filesystems (see copy.Move)
+func (journ *Journal) Move(source, dest string) error {
+	if journ.IsDryRun() {
+		return nil
+	}
+	if err := copy.Move(source, dest); err != nil {
+		return err
+	}
+	return journ.record(&Action{Type: MOVE, Source: source, Dest: dest})
+}
+
+// Copy : Copy file and record it
+func (journ *Journal) Copy(source, dest string) error {
+	return journ.CopyVerify(source, dest, nil)
+}
+
+// CopyVerify : Copy file, check the copy matches the source (see copy.FileVerify) and record it
+func (journ *Journal) CopyVerify(source, dest string, hasher copy.Hasher) error {
+	if journ.IsDryRun() {
+		return nil
+	}
+	if err := <-copy.FileVerify(source, dest, hasher); err != nil {
+		return err
+	}
+	return journ.record(&Action{Type: COPY, Source: source, Dest: dest})
+}
+
+// Create : Record a file that has been created by other means (ie by an external command)
+func (journ *Journal) Create(dest string) error {
+	if journ.IsDryRun() {
+		return nil
+	}
+	return journ.record(&Action{Type: CREATE, Dest: dest})
+}
+
+// Chmod : Change file permissions and record the previous permissions
+func (journ *Journal) Chmod(dest string, mode os.FileMode) error {
+	if journ.IsDryRun() {
+		return nil
+	}
+	info, err := os.Stat(dest)
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(dest, mode); err != nil {
+		return err
+	}
+	return journ.record(&Action{Type: CHMOD, Dest: dest, Mode: info.Mode().Perm()})
+}
+
+// Mkdir : Make directory and record it. Same as os.Mkdir, an existing directory returns os.IsExist error
+func (journ *Journal) Mkdir(dest string, perm os.FileMode) error {
+	if journ.IsDryRun() {
+		return nil
+	}
+	if err := os.Mkdir(dest, perm); err != nil {
+		return err
+	}
+	return journ.record(&Action{Type: MKDIR, Dest: dest})
+}
+
+// Keep : Copy a file about to be replaced in place (ie a lockfile being rewritten) and record it, so undo can put it back.
+// Nothing is kept if the file does not exist yet (record it with Create once made)
+func (journ *Journal) Keep(dest string) error {
+	if journ == nil || journ.DryRun {
+		return nil
+	}
+	if _, err := os.Stat(dest); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	keepDir := filepath.Join(filepath.Dir(journ.Path), KEEPDIR)
+	if err := os.MkdirAll(keepDir, 0755); err != nil {
+		return err
+	}
+	source := filepath.Join(keepDir, xid.New().String()+filepath.Ext(dest))
+	if err := <-copy.File(dest, source); err != nil {
+		return err
+	}
+	return journ.record(&Action{Type: KEEP, Source: source, Dest: dest})
+}
+
+// load : Read all actions from the journal file. Oldest first
+func (journ *Journal) load() ([]*Action, error) {
+	actions := []*Action{}
+	handle, err := os.Open(journ.Path)
+	if os.IsNotExist(err) {
+		return actions, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+	decoder := yaml.NewDecoder(handle)
+	for {
+		action := new(Action)
+		if err = decoder.Decode(action); err == io.EOF {
+			return actions, nil
+		} else if err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+}
+
+// save : Replace the journal file with the given actions
+func (journ *Journal) save(actions []*Action) error {
+	handle, err := os.OpenFile(journ.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	for _, action := range actions {
+		data, err := yaml.Marshal(action)
+		if err != nil {
+			return err
+		}
+		if _, err = handle.Write(append([]byte("---\n"), data...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// History : Get all recorded transactions. Oldest first
+func (journ *Journal) History() ([]*Transaction, error) {
+	journ.lock.Lock()
+	defer journ.lock.Unlock()
+	actions, err := journ.load()
+	if err != nil {
+		return nil, err
+	}
+	return group(actions), nil
+}
+
+// group : Collect actions into their transactions
+func group(actions []*Action) []*Transaction {
+	transactions := []*Transaction{}
+	lookup := map[string]*Transaction{}
+	for _, action := range actions {
+		transaction, ok := lookup[action.Transaction]
+		if !ok {
+			transaction = &Transaction{ID: action.Transaction, Command: action.Command, Time: action.Time}
+			lookup[action.Transaction] = transaction
+			transactions = append(transactions, transaction)
+		}
+		transaction.Actions = append(transaction.Actions, action)
+	}
+	return transactions
+}
+
+// undo : Reverse a single action
+func undo(action *Action) error {
+	switch action.Type {
+	case MOVE:
+		if _, err := os.Stat(action.Source); !os.IsNotExist(err) {
+			if err == nil {
+				return fmt.Errorf("cannot move file back, something already exists there '%s'", action.Source)
+			}
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(action.Source), 0755); err != nil {
+			return err
+		}
+		return copy.Move(action.Dest, action.Source)
+	case COPY, CREATE:
+		if err := os.Remove(action.Dest); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	case CHMOD:
+		return os.Chmod(action.Dest, action.Mode)
+	case KEEP:
+		if err := os.Remove(action.Dest); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return copy.Move(action.Source, action.Dest)
+	case MKDIR:
+		files, err := ioutil.ReadDir(action.Dest)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(files) > 0 { // Something else lives here now. Leave it be
+			return nil
+		}
+		return os.Remove(action.Dest)
+	}
+	return fmt.Errorf("unknown action '%s'", action.Type)
+}
+
+// Undo : Reverse the most recent transactions, newest first. Returns the transactions that were undone (or would be, on a dry run)
+func (journ *Journal) Undo(count int) ([]*Transaction, error) {
+	journ.lock.Lock()
+	defer journ.lock.Unlock()
+	actions, err := journ.load()
+	if err != nil {
+		return nil, err
+	}
+	transactions := group(actions)
+	if count > len(transactions) {
+		count = len(transactions)
+	}
+	if journ.DryRun { // Report what would be undone, leaving everything in place
+		undone := []*Transaction{}
+		for i := len(transactions) - 1; i >= len(transactions)-count; i-- {
+			undone = append(undone, transactions[i])
+		}
+		return undone, nil
+	}
+
+	// Walk backwards through actions, keeping track of those that remain
+	undone := []*Transaction{}
+	remaining := map[*Action]struct{}{}
+	for _, action := range actions {
+		remaining[action] = struct{}{}
+	}
+	for i := len(transactions) - 1; i >= len(transactions)-count; i-- {
+		transaction := transactions[i]
+		for j := len(transaction.Actions) - 1; j >= 0; j-- {
+			if err = undo(transaction.Actions[j]); err != nil {
+				break
+			}
+			delete(remaining, transaction.Actions[j])
+		}
+		if err != nil {
+			break
+		}
+		undone = append(undone, transaction)
+	}
+
+	// Save out what is left
+	keep := []*Action{}
+	for _, action := range actions {
+		if _, ok := remaining[action]; ok {
+			keep = append(keep, action)
+		}
+	}
+	if saveErr := journ.save(keep); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return undone, err
+}
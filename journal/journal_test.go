@@ -0,0 +1,171 @@
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/internetimagery/photos/testutil"
+)
+
+func TestNilJournal(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	// Test nil journal still performs actions
+	var journ *Journal
+	journ.Begin("test")
+	file1 := filepath.Join(tu.Dir, "file1.txt")
+	file2 := filepath.Join(tu.Dir, "subdir", "file2.txt")
+	tu.Must(journ.Mkdir(filepath.Join(tu.Dir, "subdir"), 0755))
+	tu.Must(journ.Move(file1, file2))
+	tu.AssertExists(file2)
+	tu.AssertNotExists(file1, filepath.Join(tu.Dir, JOURNALFILE))
+}
+
+func TestUndo(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	journ := NewJournal(tu.Dir)
+	file1 := filepath.Join(tu.Dir, "file1.txt")
+	file2 := filepath.Join(tu.Dir, "file2.txt")
+	subdir := filepath.Join(tu.Dir, "subdir")
+	moved := filepath.Join(subdir, "file1.txt")
+	copied := filepath.Join(subdir, "file2.txt")
+	created := filepath.Join(subdir, "file3.txt")
+
+	// First transaction, move and copy files into a new directory
+	journ.Begin("first")
+	tu.MustFatal(journ.Mkdir(subdir, 0755))
+	tu.MustFatal(journ.Move(file1, moved))
+	tu.MustFatal(journ.Copy(file2, copied))
+
+	// Second transaction, make a file and lock it down
+	journ.Begin("second")
+	handle := tu.MustFatal(os.Create(created)).(*os.File)
+	handle.Close()
+	tu.MustFatal(journ.Create(created))
+	tu.MustFatal(journ.Chmod(moved, 0444))
+
+	// Check history is recorded
+	transactions := tu.MustFatal(journ.History()).([]*Transaction)
+	if len(transactions) != 2 {
+		tu.FailNow("Expected two transactions", transactions)
+	}
+	if transactions[0].Command != "first" || len(transactions[0].Actions) != 3 {
+		tu.Fail("Bad first transaction", transactions[0])
+	}
+	if transactions[1].Command != "second" || len(transactions[1].Actions) != 2 {
+		tu.Fail("Bad second transaction", transactions[1])
+	}
+
+	// Undo the latest
+	undone := tu.MustFatal(journ.Undo(1)).([]*Transaction)
+	if len(undone) != 1 || undone[0].Command != "second" {
+		tu.Fail("Undid the wrong thing", undone)
+	}
+	tu.AssertNotExists(created)
+	if info := tu.AssertExists(moved)[0]; info != nil && info.Mode().Perm() == 0444 {
+		tu.Fail("Permissions were not restored")
+	}
+
+	// Undo more than exists
+	undone = tu.MustFatal(journ.Undo(5)).([]*Transaction)
+	if len(undone) != 1 || undone[0].Command != "first" {
+		tu.Fail("Undid the wrong thing", undone)
+	}
+	tu.AssertExists(file1, file2)
+	tu.AssertNotExists(moved, copied, subdir)
+
+	// Nothing left to undo
+	if transactions = tu.MustFatal(journ.History()).([]*Transaction); len(transactions) != 0 {
+		tu.Fail("History remains after undo", transactions)
+	}
+}
+
+func TestKeep(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	journ := NewJournal(tu.Dir)
+	file1 := filepath.Join(tu.Dir, "file1.txt")
+	file2 := filepath.Join(tu.Dir, "file2.txt")
+
+	// Replace a file in place, and keep a file that does not exist yet
+	journ.Begin("replace")
+	tu.MustFatal(journ.Keep(file1))
+	tu.MustFatal(journ.Keep(file2))
+	tu.MustFatal(ioutil.WriteFile(file1, []byte("after\n"), 0644))
+	transactions := tu.MustFatal(journ.History()).([]*Transaction)
+	if len(transactions) != 1 || len(transactions[0].Actions) != 1 || transactions[0].Actions[0].Type != KEEP {
+		tu.FailNow("Expected one file kept", transactions)
+	}
+
+	// Undo puts the original back
+	tu.MustFatal(journ.Undo(1))
+	if data := tu.MustFatal(ioutil.ReadFile(file1)).([]byte); string(data) != "before\n" {
+		tu.FailE("before\n", string(data))
+	}
+	tu.AssertNotExists(transactions[0].Actions[0].Source)
+}
+
+func TestUndoBlocked(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	journ := NewJournal(tu.Dir)
+	file1 := filepath.Join(tu.Dir, "file1.txt")
+	moved := filepath.Join(tu.Dir, "moved.txt")
+
+	journ.Begin("move")
+	tu.MustFatal(journ.Move(file1, moved))
+
+	// Something takes the original spot
+	handle := tu.MustFatal(os.Create(file1)).(*os.File)
+	handle.Close()
+
+	if _, err := journ.Undo(1); err == nil {
+		tu.Fail("Allowed undo to overwrite existing file")
+	}
+	tu.AssertExists(file1, moved)
+
+	// Failed undo should remain in history
+	if transactions := tu.MustFatal(journ.History()).([]*Transaction); len(transactions) != 1 {
+		tu.Fail("Lost history of failed undo", transactions)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	journ := NewJournal(tu.Dir)
+	file1 := filepath.Join(tu.Dir, "file1.txt")
+	subdir := filepath.Join(tu.Dir, "subdir")
+	moved := filepath.Join(subdir, "file1.txt")
+
+	journ.Begin("copy")
+	tu.MustFatal(journ.Copy(file1, filepath.Join(tu.Dir, "copied.txt")))
+
+	// Test nothing is changed or recorded
+	journ.DryRun = true
+	journ.Begin("dry")
+	tu.Must(journ.Mkdir(subdir, 0755))
+	tu.Must(journ.Move(file1, moved))
+	tu.Must(journ.Copy(file1, moved))
+	tu.Must(journ.Chmod(file1, 0444))
+	tu.AssertExists(file1)
+	tu.AssertNotExists(subdir)
+
+	// Test undo reports without undoing
+	undone := tu.MustFatal(journ.Undo(1)).([]*Transaction)
+	if len(undone) != 1 || undone[0].Command != "copy" {
+		tu.Fail("Expected copy transaction", undone)
+	}
+	tu.AssertExists(filepath.Join(tu.Dir, "copied.txt"))
+	if transactions := tu.MustFatal(journ.History()).([]*Transaction); len(transactions) != 1 {
+		tu.Fail("Expected history to be untouched", transactions)
+	}
+}
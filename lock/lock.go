@@ -9,12 +9,16 @@ import (
 	"image/png"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	gosort "sort"
 	"time"
 
 	"github.com/corona10/goimagehash"
+	"github.com/internetimagery/photos/context"
 	"github.com/internetimagery/photos/format"
+	"github.com/internetimagery/photos/progress"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -34,6 +38,21 @@ func GenerateContentHash(hashType string, handle io.Reader) (string, error) {
 	return "", fmt.Errorf("Unknown hash format '%s'", hashType)
 }
 
+// ContentHash : Hash content the same way as the lock. Fits copy.Hasher, to check copies against their source
+func ContentHash(handle io.Reader) (string, error) {
+	return GenerateContentHash("SHA256", handle) // SHA256 hardcoded for now
+}
+
+// HashFile : Get the content hash of a file, the same way as the lock
+func HashFile(filename string) (string, error) {
+	handle, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer handle.Close()
+	return ContentHash(handle)
+}
+
 // GeneratePerceptualHash : Generate hash representing visual to compare imagery
 func GeneratePerceptualHash(hashType string, handle io.ReadSeeker) (string, error) {
 	img, err := jpeg.Decode(handle)
@@ -73,20 +92,29 @@ func GeneratePerceptualHash(hashType string, handle io.ReadSeeker) (string, erro
 
 // IsSamePerceptualHash : Hash comparison looking for equality
 func IsSamePerceptualHash(hash1, hash2 string) (bool, error) {
-	test1, err := goimagehash.ImageHashFromString(hash1)
+	return IsSimilarPerceptualHash(hash1, hash2, 4)
+}
+
+// IsSimilarPerceptualHash : Hash comparison looking for images within a given distance (threshold) of one another
+func IsSimilarPerceptualHash(hash1, hash2 string, threshold int) (bool, error) {
+	dist, err := PerceptualHashDistance(hash1, hash2)
 	if err != nil {
 		return false, err
 	}
-	test2, err := goimagehash.ImageHashFromString(hash2)
+	return dist <= threshold, nil
+}
+
+// PerceptualHashDistance : Number of bits that differ between two hashes (hamming distance)
+func PerceptualHashDistance(hash1, hash2 string) (int, error) {
+	test1, err := goimagehash.ImageHashFromString(hash1)
 	if err != nil {
-		return false, err
+		return 0, err
 	}
-
-	dist, err := test1.Distance(test2)
+	test2, err := goimagehash.ImageHashFromString(hash2)
 	if err != nil {
-		return false, err
+		return 0, err
 	}
-	return dist < 5, nil
+	return test1.Distance(test2)
 }
 
 // Snapshot : Hold information about a particular files information
@@ -145,9 +173,49 @@ func (sshot *Snapshot) Generate(filename string) chan error {
 	return done
 }
 
+// File states, comparing a file to the lock
+const (
+	UNCHANGED   = "unchanged"    // File matches the lock
+	MODIFIED    = "modified"     // Content no longer matches
+	SIZECHANGED = "size-changed" // Size no longer matches
+	MISSING     = "missing"      // File in the lock no longer exists
+	NEW         = "new"          // File not in the lock yet
+	RENAMED     = "renamed"      // File in the lock found under another name
+)
+
+// Result : How a file compares to the lock
+type Result struct {
+	Path   string `json:"path"`             // File checked
+	State  string `json:"state"`            // How it compares (ie unchanged, modified)
+	Detail string `json:"detail,omitempty"` // What does not match, or where a renamed file was before
+}
+
+// Mismatch : File no longer matches the lock
+func (result *Result) Mismatch() bool {
+	return result.State == MODIFIED || result.State == SIZECHANGED || result.State == MISSING
+}
+
+// Results : How files in an event compare to the lock. Ordered by path
+type Results []*Result
+
+// Err : A MissmatchError describing any files that no longer match the lock. Nil if they all match
+func (results Results) Err() error {
+	count := 0
+	for _, result := range results {
+		if result.Mismatch() {
+			count++
+		}
+	}
+	if count == 0 {
+		return nil
+	}
+	return &MissmatchError{err: fmt.Sprintf("%d file(s) do not match the lock", count)}
+}
+
 // MissmatchError : Error type for missmatches
 type MissmatchError struct {
-	err string
+	err   string
+	State string // How the file does not match (ie modified, missing)
 }
 
 func (err *MissmatchError) Error() string {
@@ -156,6 +224,11 @@ func (err *MissmatchError) Error() string {
 
 // CheckFile : Check if a snapshot matches corresponding file. Return missmatch error if not matching
 func (sshot *Snapshot) CheckFile(filename string) error {
+	return sshot.checkFile(filename, false)
+}
+
+// checkFile : Check snapshot matches file. Thorough checks hash the content, even if the modification time matches
+func (sshot *Snapshot) checkFile(filename string, thorough bool) error {
 	// Get a handle
 	handle, err := os.Open(filename)
 	if err != nil {
@@ -168,9 +241,9 @@ func (sshot *Snapshot) CheckFile(filename string) error {
 	}
 
 	if info.Size() != sshot.Size {
-		return &MissmatchError{"Size does not match: " + filename}
+		return &MissmatchError{err: "Size does not match: " + filename, State: SIZECHANGED}
 	}
-	if info.ModTime() == sshot.ModTime { // There needs to be some margin of error here. But how much? What does rclone do?
+	if !thorough && info.ModTime() == sshot.ModTime { // There needs to be some margin of error here. But how much? What does rclone do?
 		// Roughly conclude a match!
 		return nil
 	}
@@ -179,7 +252,7 @@ func (sshot *Snapshot) CheckFile(filename string) error {
 		return err
 	}
 	if hash != sshot.ContentHash["SHA256"] {
-		return &MissmatchError{"Content does not match: " + filename}
+		return &MissmatchError{err: "Content does not match: " + filename, State: MODIFIED}
 	}
 	return nil
 }
@@ -218,26 +291,35 @@ func (lock *LockMap) Load(handle io.Reader) error {
 	return yaml.Unmarshal(data, &lock)
 }
 
-// LockEvent : Attempt to lock event. If lock exists, check for any changes and update lock.
-func LockEvent(directoryname string, force bool) error {
-	// Grab media from within file
-	mediaList, err := format.GetMediaFromDirectory(directoryname)
+// ReadLockFile : Load lockfile data from within an event directory. Missing lockfile returns os.IsNotExist error
+func ReadLockFile(directoryname string) (LockMap, error) {
+	lockmap := LockMap{}
+	handle, err := os.Open(filepath.Join(directoryname, LOCKFILENAME))
 	if err != nil {
-		return err
+		return lockmap, err
 	}
+	defer handle.Close()
+	return lockmap, lockmap.Load(handle)
+}
 
-	// Load lockfile snapshot data if it exists
-	lockmapPath := filepath.Join(directoryname, LOCKFILENAME)
-	lockmap := LockMap{}
-	if handle, err := os.Open(lockmapPath); err == nil {
-		err = lockmap.Load(handle)
-		handle.Close()
-		if err != nil {
-			return err
-		}
-	} else if !os.IsNotExist(err) {
+// WriteLockFile : Save lockfile data into an event directory, replacing what was there
+func WriteLockFile(directoryname string, lockmap LockMap) error {
+	handle, err := os.OpenFile(filepath.Join(directoryname, LOCKFILENAME), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
 		return err
 	}
+	defer handle.Close()
+	return lockmap.Save(handle)
+}
+
+// checkEvent : Compare formatted media in an event against the lock. Returns how each file compares, along with snapshots of files not in the lock.
+// Thorough checks hash every file, rather than trusting matching modification times.
+func checkEvent(name, directoryname string, lockmap LockMap, thorough bool) (Results, map[string]*Snapshot, error) {
+	results, snapshots := Results{}, map[string]*Snapshot{}
+	mediaList, err := format.GetMediaFromDirectory(directoryname)
+	if err != nil {
+		return results, snapshots, err
+	}
 
 	// Sort out our files!
 	newFiles := map[string]struct{}{}
@@ -263,63 +345,181 @@ func LockEvent(directoryname string, force bool) error {
 
 	// If we have nothing to do... we're done!
 	if len(newFiles) == 0 && len(checkFiles) == 0 && len(removedFiles) == 0 {
-		return nil
+		return results, snapshots, nil
+	}
+
+	// Keep track of how far along we are
+	report := progress.NewReporter(name)
+	defer report.Close()
+	sizes := map[string]int64{}
+	for filename := range newFiles {
+		sizes[filename] = 0
+	}
+	for filename := range checkFiles {
+		sizes[filename] = 0
+	}
+	for filename := range sizes {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return results, snapshots, err
+		}
+		sizes[filename] = info.Size()
+		report.Expect(1, info.Size())
 	}
 
 	// First, we'll make snapshots out of our new files
-	newSnapshots := map[*Snapshot]chan error{}
+	jobs := map[string]chan error{}
 	for filename := range newFiles {
-		sshot := new(Snapshot)
-		newSnapshots[sshot] = sshot.Generate(filename)
+		snapshots[filename] = new(Snapshot)
+		jobs[filename] = snapshots[filename].Generate(filename)
 	}
-	for sshot, job := range newSnapshots {
+	for filename, job := range jobs {
 		if err = <-job; err != nil {
-			return err
+			return results, snapshots, err
 		}
-		lockmap[sshot.Name] = sshot
+		report.Done(filename, sizes[filename])
 	}
 
 	// Next we'll check to see if any missing files are actually in the new snapshots (rename)
+	renamed := map[string]string{}
 	for basename := range removedFiles {
-		ok := false
-		for sshot := range newSnapshots { // compare hashes (hard coded sha256 for now...)
-			if lockmap[basename].ContentHash["SHA256"] == sshot.ContentHash["SHA256"] {
-				ok = true // Looks like this file matches another new file. Transparently deal with the rename and continue
-				delete(lockmap, basename)
+		oldname := filepath.Join(directoryname, basename)
+		found := false
+		for filename, sshot := range snapshots { // compare hashes (hard coded sha256 for now...)
+			if _, ok := renamed[filename]; !ok && lockmap[basename].ContentHash["SHA256"] == sshot.ContentHash["SHA256"] {
+				renamed[filename] = oldname // Looks like this file matches another new file. Transparently deal with the rename and continue
+				found = true
+				break
 			}
 		}
-		if !ok && !force {
-			return &MissmatchError{"File was removed: " + basename}
+		if !found {
+			results = append(results, &Result{Path: oldname, State: MISSING, Detail: "File was removed: " + basename})
+		}
+	}
+	for filename := range newFiles {
+		if oldname, ok := renamed[filename]; ok {
+			results = append(results, &Result{Path: filename, State: RENAMED, Detail: oldname})
+		} else {
+			results = append(results, &Result{Path: filename, State: NEW})
 		}
 	}
 
 	// Finally lets verify that our existing files are still ok!
 	for filename, sshot := range checkFiles {
-		if err = sshot.CheckFile(filename); err != nil {
-			if _, ok := err.(*MissmatchError); !ok {
-				return err
-			} else if !force {
-				return err
+		report.Status("Checking", filename)
+		if err = sshot.checkFile(filename, thorough); err != nil {
+			missmatch, ok := err.(*MissmatchError)
+			if !ok {
+				return results, snapshots, err
 			}
+			results = append(results, &Result{Path: filename, State: missmatch.State, Detail: missmatch.Error()})
+		} else {
+			results = append(results, &Result{Path: filename, State: UNCHANGED})
 		}
+		report.Done(filename, sizes[filename])
 	}
+	gosort.Slice(results, func(i, j int) bool { return results[i].Path < results[j].Path })
+	return results, snapshots, nil
+}
 
-	// Save lockmap!
-	handle, err := os.OpenFile(lockmapPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+// VerifyEvent : Check every file in a locked event against the lock, hashing each in full. Nothing is changed.
+func VerifyEvent(directoryname string) (Results, error) {
+	lockmap, err := ReadLockFile(directoryname)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer handle.Close()
-	if err = lockmap.Save(handle); err != nil {
-		return err
+	results, _, err := checkEvent("verify", directoryname, lockmap, true)
+	return results, err
+}
+
+// LockEvent : Attempt to lock event. If lock exists, check for any changes and update lock.
+// Returns how each file compares to the lock. All files are checked, before failing on any that do not match (MissmatchError).
+func LockEvent(cxt *context.Context, directoryname string, force bool) (Results, error) {
+	// Refuse to lock while work is unfinished. ie an interrupted rename may have left placeholder files
+	files, err := ioutil.ReadDir(directoryname)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if format.IsTempPath(file.Name()) {
+			return nil, fmt.Errorf("refusing to lock with temporary files still inside '%s'. Has a rename been interrupted? Run rename again to recover", filepath.Join(directoryname, file.Name()))
+		}
+	}
+
+	// Load lockfile snapshot data if it exists
+	lockmap, err := ReadLockFile(directoryname)
+	newLock := os.IsNotExist(err)
+	if err != nil && !newLock {
+		return nil, err
+	}
+
+	// Compare our files to the lock
+	results, snapshots, err := checkEvent("lock", directoryname, lockmap, false)
+	if err != nil || len(results) == 0 {
+		return results, err
+	}
+	var missmatch error
+	newFiles := []string{}
+	for _, result := range results {
+		switch result.State {
+		case NEW, RENAMED:
+			if result.State == RENAMED {
+				delete(lockmap, filepath.Base(result.Detail))
+			}
+			lockmap[filepath.Base(result.Path)] = snapshots[result.Path]
+			newFiles = append(newFiles, result.Path)
+		case MISSING, MODIFIED, SIZECHANGED:
+			if missmatch == nil {
+				missmatch = &MissmatchError{err: result.Detail, State: result.State}
+			}
+		}
+	}
+	if missmatch != nil && !force {
+		return results, missmatch
+	}
+	for _, result := range results { // Forced. Take the current state of changed files as the new snapshot
+		switch result.State {
+		case MISSING:
+			delete(lockmap, filepath.Base(result.Path))
+		case MODIFIED, SIZECHANGED:
+			sshot := new(Snapshot)
+			if err = <-sshot.Generate(result.Path); err != nil {
+				return results, err
+			}
+			lockmap[filepath.Base(result.Path)] = sshot
+		}
+	}
+
+	// Report what is being locked
+	for _, filename := range newFiles {
+		log.Println("Locking:", filename)
+	}
+	if cxt.Journal.IsDryRun() { // Checks passed. Leave the lockfile as it is
+		return results, nil
+	}
+
+	// Save lockmap!
+	if err = cxt.Journal.Keep(filepath.Join(directoryname, LOCKFILENAME)); err != nil {
+		return results, err
+	}
+	if err = WriteLockFile(directoryname, lockmap); err != nil {
+		return results, err
+	}
+	if newLock {
+		if err = cxt.Journal.Create(filepath.Join(directoryname, LOCKFILENAME)); err != nil {
+			return results, err
+		}
 	}
 
 	// Make new files readonly
-	for filename := range newFiles {
-		err := ReadOnly(filename)
+	for _, filename := range newFiles {
+		info, err := os.Stat(filename)
 		if err != nil {
-			return err
+			return results, err
+		}
+		if err = cxt.Journal.Chmod(filename, info.Mode().Perm()&0444); err != nil {
+			return results, err
 		}
 	}
-	return nil
+	return results, nil
 }
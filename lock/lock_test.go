@@ -2,12 +2,14 @@ package lock
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/internetimagery/photos/context"
 	"github.com/internetimagery/photos/testutil"
 )
 
@@ -212,7 +214,7 @@ func TestLockEvent(t *testing.T) {
 
 	event := filepath.Join(tu.Dir, "event01")
 	testfile := filepath.Join(event, "event01_001.txt")
-	tu.Must(LockEvent(event, false)) // Lock down the event!
+	tu.Must(LockEvent(new(context.Context), event, false)) // Lock down the event!
 	tu.AssertExists(filepath.Join(event, LOCKFILENAME))
 	testReadOnly(tu, testfile)
 }
@@ -222,7 +224,7 @@ func TestLockEventNew(t *testing.T) {
 	defer tu.LoadTestdata()()
 
 	event := filepath.Join(tu.Dir, "event01")
-	tu.Must(LockEvent(event, false))
+	tu.Must(LockEvent(new(context.Context), event, false))
 
 	testReadOnly(tu, filepath.Join(event, "event01_001.txt"))
 	testReadOnly(tu, filepath.Join(event, "event01_002.txt"))
@@ -242,14 +244,15 @@ func TestLockEventMissing(t *testing.T) {
 	defer tu.LoadTestdata()()
 
 	event := filepath.Join(tu.Dir, "event01")
-	if err, ok := LockEvent(event, false).(*MissmatchError); !ok {
+	_, err := LockEvent(new(context.Context), event, false)
+	if _, ok := err.(*MissmatchError); !ok {
 		if err == nil {
 			tu.Fail("Did not trigger error for missing file")
 		} else {
 			tu.Fail(err)
 		}
 	}
-	tu.Must(LockEvent(event, true)) // Force!
+	tu.Must(LockEvent(new(context.Context), event, true)) // Force!
 }
 
 func TestLockEventChanged(t *testing.T) {
@@ -257,14 +260,15 @@ func TestLockEventChanged(t *testing.T) {
 	defer tu.LoadTestdata()()
 
 	event := filepath.Join(tu.Dir, "event01")
-	if err, ok := LockEvent(event, false).(*MissmatchError); !ok {
+	_, err := LockEvent(new(context.Context), event, false)
+	if _, ok := err.(*MissmatchError); !ok {
 		if err == nil {
 			tu.Fail("Did not trigger error for changed data")
 		} else {
 			tu.Fail(err)
 		}
 	}
-	tu.Must(LockEvent(event, true)) // Force it
+	tu.Must(LockEvent(new(context.Context), event, true)) // Force it
 }
 
 func TestLockEventRenamed(t *testing.T) {
@@ -272,5 +276,56 @@ func TestLockEventRenamed(t *testing.T) {
 	defer tu.LoadTestdata()()
 
 	event := filepath.Join(tu.Dir, "event01")
-	tu.Must(LockEvent(event, false))
+	tu.Must(LockEvent(new(context.Context), event, false))
+}
+
+func TestVerifyEvent(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	event := filepath.Join(tu.Dir, "event01")
+	if _, err := VerifyEvent(event); !os.IsNotExist(err) {
+		tu.Fail("Verified an event that was not locked")
+	}
+	tu.MustFatal(LockEvent(new(context.Context), event, false))
+
+	filename := func(index int) string {
+		return filepath.Join(event, fmt.Sprintf("event01_%03d.txt", index))
+	}
+	for index := 1; index <= 4; index++ {
+		tu.MustFatal(os.Chmod(filename(index), 0644))
+	}
+	info := tu.MustFatal(os.Stat(filename(1))).(os.FileInfo)
+	tu.MustFatal(ioutil.WriteFile(filename(1), []byte("file NUMBER 1\n"), 0644)) // Same size, different content
+	tu.MustFatal(os.Chtimes(filename(1), info.ModTime(), info.ModTime()))
+	tu.MustFatal(ioutil.WriteFile(filename(2), []byte("file number two\n"), 0644))
+	tu.MustFatal(os.Remove(filename(3)))
+	tu.MustFatal(os.Rename(filename(4), filename(6)))
+	tu.MustFatal(ioutil.WriteFile(filename(7), []byte("file number 7\n"), 0644))
+
+	results, err := VerifyEvent(event)
+	tu.MustFatal(err)
+	expect := []*Result{
+		{Path: filename(1), State: MODIFIED},
+		{Path: filename(2), State: SIZECHANGED},
+		{Path: filename(3), State: MISSING},
+		{Path: filename(5), State: UNCHANGED},
+		{Path: filename(6), State: RENAMED, Detail: filename(4)},
+		{Path: filename(7), State: NEW},
+	}
+	if len(results) != len(expect) {
+		tu.FailNow(fmt.Sprintf("Expected %d results, got %d", len(expect), len(results)))
+	}
+	for i, result := range results {
+		if result.Path != expect[i].Path || result.State != expect[i].State {
+			tu.FailE(expect[i], result)
+		}
+		if result.State == RENAMED && result.Detail != expect[i].Detail {
+			tu.FailE(expect[i].Detail, result.Detail)
+		}
+	}
+	if _, ok := results.Err().(*MissmatchError); !ok {
+		tu.Fail("Mismatches not reported")
+	}
+	tu.AssertNotExists(filename(4))
 }
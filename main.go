@@ -3,20 +3,28 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	gosort "sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/internetimagery/photos/backup"
 	"github.com/internetimagery/photos/config"
+	"github.com/internetimagery/photos/confirm"
 	"github.com/internetimagery/photos/context"
+	"github.com/internetimagery/photos/dupes"
 	"github.com/internetimagery/photos/format"
 	"github.com/internetimagery/photos/lock"
+	"github.com/internetimagery/photos/progress"
 	"github.com/internetimagery/photos/rename"
+	"github.com/internetimagery/photos/search"
 	"github.com/internetimagery/photos/sort"
 	"github.com/internetimagery/photos/tags"
 )
@@ -29,34 +37,104 @@ func sendHelp() {
 	fmt.Println("Command to manage photos naming, compression, backup.")
 	fmt.Println("Usage:")
 	root := filepath.Base(os.Args[0])
+	fmt.Println("  ", root, "--dry-run <command> ...                   ", "// Report what a command would change (sort, rename, tag, lock, backup etc) without touching any files.")
+	fmt.Println("  ", root, "--yes <command> ...                       ", "// Answer yes to any confirmation, for running unattended.")
+	fmt.Println("  ", root, "--no-input <command> ...                  ", "// Fail instead of asking for confirmation.")
+	fmt.Println("  ", root, "--json <command> ...                      ", "// Write the results of a command to stdout as JSON (messages go to stderr).")
+	fmt.Println("Confirmation can also be set with the environment variable", confirm.ENV+"=ask|yes|no-input")
 	fmt.Println("  ", root, "version                                   ", "// Print out current version of the tool.")
 	fmt.Println("  ", root, "init <name>                               ", "// Set up a new project. Creates a config file also serving as the root of the project.")
-	fmt.Println("  ", root, "sort [--copy] <filename> <filename> ...   ", "// Bring in external files, and sort them by date.")
+	fmt.Println("  ", root, "sort [--copy [--verify]] [--recursive] [--no-sidecars] [--allow-duplicates] [--offset <duration>] [--tz <timezone>] <filename> <filename> ...", "// Bring in external files, and sort them by date. Skipping those already in the project.")
 	fmt.Println("  ", root, "rename                                    ", "// Rename (and compress) files in current directory to their parent directory's namespace (event).")
 	fmt.Println("  ", root, "tag [--remove] <filename/index> <filename/index...> -- <tag> <tag...>", "// Add and optionally remove tags from renamed files.")
+	fmt.Println("  ", root, "tags list                                 ", "// List all tags used across the project, along with how often they are used.")
+	fmt.Println("  ", root, "tags rename <old> <new>                   ", "// Rename a tag on all media across the project.")
+	fmt.Println("  ", root, "tags merge <tag> <tag...> -> <new>        ", "// Merge tags into a single tag on all media across the project.")
 	fmt.Println("  ", root, "lock [--force]                            ", "// Make files readonly and create a snapshot of their contents. Check existing locked files for changes since last lock.")
-	fmt.Println("  ", root, "backup <name>                             ", "// Execute specified procedure in config to backup files from the current directory. Files are locked first by default.")
+	fmt.Println("  ", root, "verify [--recursive]                      ", "// Check every locked file (or every locked event in the project) against its snapshot, and report how each has changed.")
+	fmt.Println("  ", root, "backup status                             ", "// List every event in the project against every backup in config. When it was last backed up, and if it has changed since.")
+	fmt.Println("  ", root, "backup verify <name>                      ", "// Check the backed up copies of locked events within the current directory against the lock. Mirrors, or backups with a restore command.")
+	fmt.Println("  ", root, "backup <name>                             ", "// Execute specified procedure in config to backup files from the current directory (or every event, from the root). Files are locked first by default.")
+	fmt.Println("  ", root, "restore <name> [event]                    ", "// Bring back missing or damaged files in locked events (within the current directory) from a backup.")
+	fmt.Println("  ", root, "search [--from YYYY-MM-DD] [--to YYYY-MM-DD] <query>", "// Search the project for media by tags and event names. ie: alice AND (beach OR pool) NOT 2017")
+	fmt.Println("  ", root, "history                                   ", "// List recent commands that changed files, newest first.")
+	fmt.Println("  ", root, "undo [n]                                  ", "// Reverse the changes made to files by the last (or last n) commands.")
+	fmt.Println("  ", root, "dupes [--threshold N] [--yaml] [--quarantine]", "// Report exact and similar media across all locked events. Optionally move duplicates into a quarantine folder.")
 }
 
-// question : Ask yes or no
-func question() bool {
-	fmt.Print("Is this ok? (y|n) : ")
-	var response string
-	_, err := fmt.Scanln(&response)
-	if err != nil && err != io.EOF {
-		panic(err)
+// stdout : Where results are written. Swappable for testing
+var stdout io.Writer = os.Stdout
+
+// writeJSON : Write out machine readable results
+func writeJSON(handle io.Writer, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
 	}
-	return strings.TrimSpace(response) == "y"
+	_, err = handle.Write(append(data, '\n'))
+	return err
 }
 
 // run : Do the thing
-func run(cwd string, args []string) error {
+func run(cwd string, args []string) (err error) {
+	// Pull out global options
+	dryRun, asJSON, confirmMode, commandArgs := false, false, "", []string{}
+	for _, arg := range args {
+		switch arg {
+		case "--dry-run":
+			dryRun = true
+		case "--json":
+			asJSON = true
+		case "--yes":
+			confirmMode = confirm.YES
+		case "--no-input":
+			confirmMode = confirm.NOINPUT
+		default:
+			commandArgs = append(commandArgs, arg)
+		}
+	}
+	args = commandArgs
+
 	// Check for no arguments
 	if len(args) == 1 {
 		sendHelp()
 		return nil
 	}
+
+	// Results of the command, written out as JSON when asked. Stdout is kept clear for them, so messages go to stderr
+	var result interface{}
+	out := io.Writer(os.Stdout)
+	if asJSON {
+		out = os.Stderr
+		defer func(output *os.File) { progress.Output = output }(progress.Output)
+		progress.Output = os.Stderr // Progress too
+		defer func() {
+			if result == nil {
+				return
+			}
+			if jsonErr := writeJSON(stdout, result); err == nil {
+				err = jsonErr
+			}
+		}()
+	}
+
+	// Set up how we confirm changes. On a dry run nothing changes, so there is nothing to confirm
+	confirmer, err := confirm.NewConfirm(confirmMode)
+	if err != nil {
+		return err
+	}
+	confirmer.Output = out
+	ask := confirmer.Ask
+	if dryRun {
+		defer log.SetPrefix(log.Prefix())
+		log.SetPrefix("DRY RUN: ")
+		ask = (&confirm.Confirm{Mode: confirm.YES, Output: out}).Ask
+	}
+
 	cxt, err := context.NewContext(cwd)
+	if cxt != nil && asJSON {
+		cxt.Output = os.Stderr // Commands (ie compression, backups) print to stderr too
+	}
 
 	// We have an argument, nab it and do stuff!
 
@@ -71,12 +149,12 @@ func run(cwd string, args []string) error {
 		sendHelp()
 		return nil
 
-	case "-v":
-		fmt.Println(VERSION)
-		return nil
-
-	case "version":
-		fmt.Println(VERSION)
+	case "-v", "version":
+		if asJSON {
+			result = map[string]string{"version": VERSION}
+			return nil
+		}
+		fmt.Fprintln(out, VERSION)
 		return nil
 
 	case "init": // Create a starter config file at working directory, to signify the root of the project.
@@ -85,12 +163,18 @@ func run(cwd string, args []string) error {
 				return fmt.Errorf("Please provide a name for your project.")
 			} else {
 				name := args[2]
-				fmt.Printf("About to initialize your project '%s' in '%s'\n", name, cwd)
-				if question() {
+				fmt.Fprintf(out, "About to initialize your project '%s' in '%s'\n", name, cwd)
+				if ok, err := ask(); err != nil {
+					return err
+				} else if ok {
 					configPath := filepath.Join(cwd, context.ROOTCONF)
 					newConfig := config.NewConfig(name)
-					fmt.Printf("Creating config file '%s'\n", configPath)
-					fmt.Println("Be sure to edit it later with what you need. :)")
+					fmt.Fprintf(out, "Creating config file '%s'\n", configPath)
+					result = map[string]string{"config": configPath}
+					if dryRun {
+						return nil
+					}
+					fmt.Fprintln(out, "Be sure to edit it later with what you need. :)")
 					handle, err := os.Create(configPath)
 					if err != nil {
 						return err
@@ -114,6 +198,10 @@ func run(cwd string, args []string) error {
 		return err
 	}
 
+	// Record changes made to files under this command
+	cxt.Journal.Begin(strings.Join(args[1:], " "))
+	cxt.Journal.DryRun = dryRun
+
 	// Nab the rest of the commands
 	switch args[1] {
 
@@ -121,18 +209,47 @@ func run(cwd string, args []string) error {
 		if len(args) < 3 {
 			return fmt.Errorf("Please provide a source directory to sort")
 		}
-		sortTargets, copyFile := []string{}, false
-		for _, target := range args[2:] {
-			if target == "--copy" {
-				copyFile = true
-			} else {
-				sortTargets = append(sortTargets, target)
+		sortTargets, options := []string{}, new(sort.Options)
+		for i := 2; i < len(args); i++ {
+			switch args[i] {
+			case "--copy":
+				options.Copy = true
+			case "--verify":
+				options.Verify = true
+			case "--allow-duplicates":
+				options.AllowDuplicates = true
+			case "--recursive":
+				options.Recursive = true
+			case "--no-sidecars":
+				options.SkipSidecars = true
+			case "--offset", "--tz":
+				i++
+				if i >= len(args) {
+					return fmt.Errorf("Please provide a value for '%s'", args[i-1])
+				}
+				if args[i-1] == "--offset" {
+					if options.Offset, err = time.ParseDuration(args[i]); err != nil {
+						return fmt.Errorf("Invalid offset '%s'. Expected a duration, ie 1h or -30m", args[i])
+					}
+				} else if options.Location, err = time.LoadLocation(args[i]); err != nil {
+					return fmt.Errorf("Invalid timezone '%s'. Expected a name, ie Europe/London", args[i])
+				}
+			default:
+				sortTargets = append(sortTargets, args[i])
 			}
 		}
-		fmt.Printf("About to sort media in '%s'\n", strings.Join(sortTargets, ", "))
-		if question() {
-			fmt.Println("Sorting...")
-			if err = sort.SortMedia(cxt, copyFile, sortTargets...); err != nil {
+		if len(sortTargets) == 0 {
+			return fmt.Errorf("Please provide a source directory to sort")
+		}
+		if options.Verify && !options.Copy {
+			return fmt.Errorf("Verify only applies to copies. Please use it along with --copy")
+		}
+		fmt.Fprintf(out, "About to sort media in '%s'\n", strings.Join(sortTargets, ", "))
+		if ok, err := ask(); err != nil {
+			return err
+		} else if ok {
+			fmt.Fprintln(out, "Sorting...")
+			if result, err = sort.SortMedia(cxt, options, sortTargets...); err != nil {
 				return err
 			}
 		}
@@ -144,11 +261,13 @@ func run(cwd string, args []string) error {
 		if cxt.WorkingDir == cxt.SortDir {
 			return fmt.Errorf("Cannot rename media in the sort directory. Please move to your own structure when ready to format.")
 		}
-		fmt.Printf("About to rename media in '%s'\n", cxt.WorkingDir)
-		if question() {
-			fmt.Printf("Renaming media in '%s'\n", cxt.WorkingDir)
+		fmt.Fprintf(out, "About to rename media in '%s'\n", cxt.WorkingDir)
+		if ok, err := ask(); err != nil {
+			return err
+		} else if ok {
+			fmt.Fprintf(out, "Renaming media in '%s'\n", cxt.WorkingDir)
 			// TODO: Add --no-compress option
-			if err = rename.Rename(cxt, true); err != nil {
+			if result, err = rename.Rename(cxt, true); err != nil {
 				return err
 			}
 		}
@@ -228,11 +347,98 @@ func run(cwd string, args []string) error {
 			return fmt.Errorf("no tags specified")
 		}
 
+		// Check new tags for possible spelling mistakes against those already in use
+		if !remove {
+			existing, err := tags.CollectTags(cxt)
+			if err != nil {
+				return err
+			}
+			for j, tagname := range tagNames {
+				if suggestion := tags.SuggestTag(tagname, existing); suggestion != "" {
+					if confirmer.Mode != confirm.ASK { // Never swap tags without someone there to agree to it
+						log.Printf("Tag '%s' looks similar to the existing tag '%s' (used %d times). Keeping '%s'.\n", tagname, suggestion, existing[suggestion], tagname)
+						continue
+					}
+					fmt.Fprintf(out, "Tag '%s' looks similar to the existing tag '%s' (used %d times). About to use '%s' instead.\n", tagname, suggestion, existing[suggestion], suggestion)
+					if ok, err := confirmer.Ask(); err != nil {
+						return err
+					} else if ok {
+						tagNames[j] = suggestion
+					}
+				}
+			}
+		}
+
 		// Apply / Remove tags!
 		if remove {
-			return tags.RemoveTag(tagMedia, tagNames)
+			result, err = tags.RemoveTag(cxt, tagMedia, tagNames)
+		} else {
+			result, err = tags.AddTag(cxt, tagMedia, tagNames)
+		}
+		return err
+
+	case "tags": // Manage tags across the whole project
+		if len(args) < 3 {
+			return fmt.Errorf("Please provide a tags command")
+		}
+		switch args[2] {
+		case "list":
+			tagCount, err := tags.CollectTags(cxt)
+			if err != nil {
+				return err
+			}
+			if asJSON {
+				result = tagCount
+				return nil
+			}
+			tagnames := []string{}
+			for tagname := range tagCount {
+				tagnames = append(tagnames, tagname)
+			}
+			gosort.Slice(tagnames, func(i, j int) bool { // Most used first
+				if tagCount[tagnames[i]] == tagCount[tagnames[j]] {
+					return tagnames[i] < tagnames[j]
+				}
+				return tagCount[tagnames[i]] > tagCount[tagnames[j]]
+			})
+			for _, tagname := range tagnames {
+				fmt.Fprintf(out, "%6d  %s\n", tagCount[tagname], tagname)
+			}
+		case "rename", "merge": // Swap tags for another across the project
+			oldTags, newTag := []string{}, ""
+			if args[2] == "rename" {
+				if len(args) != 5 {
+					return fmt.Errorf("Please provide the tag to rename, and its new name")
+				}
+				oldTags, newTag = append(oldTags, args[3]), args[4]
+			} else {
+				if len(args) < 6 || args[len(args)-2] != "->" {
+					return fmt.Errorf("Please provide the tags to merge, followed by '->' and the tag to merge them into")
+				}
+				oldTags, newTag = append(oldTags, args[3:len(args)-2]...), args[len(args)-1]
+			}
+			tagReg := regexp.MustCompile("^" + format.TagReg + "$")
+			for _, tagname := range append(oldTags, newTag) {
+				if !tagReg.MatchString(tagname) {
+					return fmt.Errorf("Invalid tag '%s'", tagname)
+				}
+			}
+			fmt.Fprintf(out, "About to replace the tags '%s' with '%s' across the project\n", strings.Join(oldTags, "', '"), newTag)
+			if ok, err := ask(); err != nil {
+				return err
+			} else if ok {
+				renameMap, err := tags.ReplaceTags(cxt, oldTags, newTag)
+				result = renameMap
+				for src, dest := range renameMap {
+					fmt.Fprintln(out, "Renamed:", src, "--->", filepath.Base(dest))
+				}
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("Unrecognized tags command '%s'", args[2])
 		}
-		return tags.AddTag(tagMedia, tagNames)
 
 	case "lock": // Lock down files to prevent accidental modification
 		if cxt.WorkingDir == cxt.Root {
@@ -241,38 +447,327 @@ func run(cwd string, args []string) error {
 		if cxt.WorkingDir == cxt.SortDir {
 			return fmt.Errorf("Cannot lock media in the sort directory. Please move to your own structure when ready to lock.")
 		}
-		fmt.Printf("Locking media in '%s'\n", cxt.WorkingDir)
+		fmt.Fprintf(out, "Locking media in '%s'\n", cxt.WorkingDir)
 		force := false
 		if len(args) > 2 && args[2] == "--force" { // Override changes instead of warning about them
 			force = true
 		}
-		if err, ok := lock.LockEvent(cxt.WorkingDir, force).(*lock.MissmatchError); ok {
-			fmt.Println("WARNING: Files have changed since they were last locked. To update them run the 'lock' command with '--force'.")
+		results, err := lock.LockEvent(cxt, cxt.WorkingDir, force)
+		result = results
+		if _, ok := err.(*lock.MissmatchError); ok {
+			for _, entry := range results {
+				if entry.Mismatch() {
+					fmt.Fprintf(out, "%-13s %s\n", entry.State, entry.Path)
+				}
+			}
+			fmt.Fprintln(out, "WARNING: Files have changed since they were last locked. To update them run the 'lock' command with '--force'.")
 			return err
 		} else if err != nil {
 			return err
 		}
 
+	case "verify": // Check locked files against their snapshots, reporting on every file
+		recursive := false
+		if len(args) > 2 && args[2] == "--recursive" { // Check every locked event in the project
+			recursive = true
+		}
+		results := lock.Results{}
+		if recursive {
+			err = cxt.WalkEvents(func(eventPath string) error {
+				if _, err := os.Stat(filepath.Join(eventPath, lock.LOCKFILENAME)); os.IsNotExist(err) {
+					return nil // Not locked. Nothing to verify
+				} else if err != nil {
+					return err
+				}
+				eventResults, err := lock.VerifyEvent(eventPath)
+				results = append(results, eventResults...)
+				return err
+			})
+		} else {
+			if _, err = os.Stat(filepath.Join(cxt.WorkingDir, lock.LOCKFILENAME)); os.IsNotExist(err) {
+				return fmt.Errorf("'%s' is not locked. Nothing to verify", cxt.WorkingDir)
+			}
+			results, err = lock.VerifyEvent(cxt.WorkingDir)
+		}
+		result = results
+		if err != nil {
+			return err
+		}
+		base := cxt.WorkingDir
+		if recursive {
+			base = cxt.Root
+		}
+		counts := map[string]int{}
+		for _, entry := range results {
+			counts[entry.State]++
+			name, relErr := filepath.Rel(base, entry.Path)
+			if relErr != nil {
+				name = entry.Path
+			}
+			if entry.State == lock.RENAMED {
+				name += " (was " + filepath.Base(entry.Detail) + ")"
+			}
+			fmt.Fprintf(out, "%-13s %s\n", entry.State, name)
+		}
+		fmt.Fprintf(out, "%d unchanged, %d modified, %d size-changed, %d missing, %d new, %d renamed\n",
+			counts[lock.UNCHANGED], counts[lock.MODIFIED], counts[lock.SIZECHANGED], counts[lock.MISSING], counts[lock.NEW], counts[lock.RENAMED])
+		return results.Err()
+
 	case "backup": // Backup files within working directory to specified destination
 		if len(args) < 3 {
 			return fmt.Errorf("please provide a name for the backup script you wish to run")
 		}
-		if cxt.WorkingDir == cxt.Root {
-			return fmt.Errorf("Cannot backup the root directory (same place as config file.)")
+		if args[2] == "status" { // Report what has been backed up where, across the project
+			statuses, err := backup.GetStatus(cxt)
+			result = statuses
+			if err != nil {
+				return err
+			}
+			lines := map[string][]string{}
+			events := []string{}
+			unsafe := map[string]struct{}{}
+			for _, status := range statuses {
+				if _, ok := lines[status.Event]; !ok {
+					events = append(events, status.Event)
+					unsafe[status.Event] = struct{}{}
+				}
+				state := "never"
+				if status.BackedUp {
+					state = status.Time.Format("2006-01-02 15:04")
+					if status.Changed {
+						state += " (changed since)"
+					} else {
+						delete(unsafe, status.Event)
+					}
+				}
+				lines[status.Event] = append(lines[status.Event], fmt.Sprintf("%s: %s", status.Name, state))
+			}
+			for _, event := range events {
+				fmt.Fprintf(out, "%-40s %s\n", event, strings.Join(lines[event], "  "))
+			}
+			fmt.Fprintf(out, "%d of %d event(s) not backed up in full anywhere\n", len(unsafe), len(events))
+			return nil
+		}
+		if args[2] == "verify" { // Check backed up copies against the lock
+			if len(args) < 4 {
+				return fmt.Errorf("please provide the name of the backup to verify")
+			}
+			results, err := backup.VerifyBackup(cxt, args[3])
+			result = results
+			if err != nil {
+				return err
+			}
+			counts := map[string]int{}
+			for _, entry := range results {
+				counts[entry.State]++
+				name, relErr := filepath.Rel(cxt.WorkingDir, entry.Path)
+				if relErr != nil {
+					name = entry.Path
+				}
+				fmt.Fprintf(out, "%-13s %s\n", entry.State, name)
+			}
+			fmt.Fprintf(out, "%d unchanged, %d modified, %d missing in backup\n", counts[lock.UNCHANGED], counts[lock.MODIFIED], counts[lock.MISSING])
+			return results.Err()
+		}
+		if cxt.WorkingDir == cxt.Root { // Backup the whole project, skipping events that are not ready
+			fmt.Fprintf(out, "About to run backup scripts that match the name '%s'.\nTo backup every event in the project\n", args[2])
+			if ok, err := ask(); err != nil || !ok {
+				return err
+			}
+			summary, err := backup.BackupProject(cxt, args[2])
+			result = summary
+			if len(summary.Skipped) > 0 {
+				fmt.Fprintf(out, "Skipped %d event(s):\n", len(summary.Skipped))
+				for _, skip := range summary.Skipped {
+					fmt.Fprintf(out, "  %s: %s\n", skip.Event, skip.Reason)
+				}
+			}
+			return err
 		}
 		if cxt.WorkingDir == cxt.SortDir {
 			return fmt.Errorf("Cannot backup media in the sort directory. Please move to your own structure and format.")
 		}
-		fmt.Printf("About to run backup scripts that match the name '%s'.\nTo backup the media in '%s'\n", args[2], cxt.WorkingDir)
-		if question() {
-			fmt.Printf("Backing up media in '%s'\n", cxt.WorkingDir)
-			if err = backup.RunBackup(cxt, args[2]); err != nil {
+		fmt.Fprintf(out, "About to run backup scripts that match the name '%s'.\nTo backup the media in '%s'\n", args[2], cxt.WorkingDir)
+		if ok, err := ask(); err != nil {
+			return err
+		} else if ok {
+			fmt.Fprintf(out, "Backing up media in '%s'\n", cxt.WorkingDir)
+			if result, err = backup.RunBackup(cxt, args[2]); err != nil {
 				return err
 			}
 		}
 
+	case "restore": // Bring back missing or damaged files from a backup
+		if len(args) < 3 {
+			return fmt.Errorf("please provide the name of the backup to restore from")
+		}
+		events := []string{}
+		if len(args) > 3 { // Restore a single event
+			event := cxt.AbsPath(args[3])
+			if !context.Within(cxt.Root, event) {
+				return fmt.Errorf("'%s' is not within the project", event)
+			}
+			if context.Within(cxt.SortDir, event) {
+				return fmt.Errorf("'%s' is within the sorted directory. Nothing to restore", event)
+			}
+			if _, err = os.Stat(filepath.Join(event, lock.LOCKFILENAME)); err != nil {
+				return fmt.Errorf("'%s' is not a locked event. Nothing to restore", event)
+			}
+			events = append(events, event)
+		} else if events, err = backup.LockedEvents(cxt, cxt.WorkingDir); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "About to restore missing or damaged files in %d locked event(s) from backup '%s'.\nDamaged files will be moved into '%s'\n", len(events), args[2], context.CORRUPTED)
+		if ok, err := ask(); err != nil {
+			return err
+		} else if ok {
+			restored, err := backup.Restore(cxt, args[2], events)
+			result = restored
+			for _, entry := range restored {
+				fmt.Fprintf(out, "%-13s %s: %s\n", entry.State, entry.Path, entry.Detail)
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "%d file(s) restored\n", len(restored))
+		}
+
+	case "history": // Show changes made to files that can be undone
+		transactions, err := cxt.Journal.History()
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			result = transactions
+			return nil
+		}
+		for i := len(transactions) - 1; i >= 0; i-- { // Newest first
+			transaction := transactions[i]
+			fmt.Fprintf(out, "%3d  %s  %-40s (%d changes)\n", len(transactions)-i, transaction.Time.Format("2006-01-02 15:04:05"), transaction.Command, len(transaction.Actions))
+		}
+
+	case "undo": // Reverse recent changes made to files
+		count := 1
+		if len(args) > 2 {
+			if count, err = strconv.Atoi(args[2]); err != nil || count < 1 {
+				return fmt.Errorf("Invalid number of commands to undo '%s'", args[2])
+			}
+		}
+		transactions, err := cxt.Journal.History()
+		if err != nil {
+			return err
+		}
+		if len(transactions) == 0 {
+			fmt.Fprintln(out, "Nothing to undo...")
+			return nil
+		}
+		if count > len(transactions) {
+			count = len(transactions)
+		}
+		fmt.Fprintln(out, "About to undo the following:")
+		for i := len(transactions) - 1; i >= len(transactions)-count; i-- {
+			fmt.Fprintf(out, "  %s  %s\n", transactions[i].Time.Format("2006-01-02 15:04:05"), transactions[i].Command)
+		}
+		if ok, err := ask(); err != nil {
+			return err
+		} else if ok {
+			undone, err := cxt.Journal.Undo(count)
+			result = undone
+			for _, transaction := range undone {
+				fmt.Fprintln(out, "Undone:", transaction.Command)
+			}
+			return err
+		}
+
+	case "dupes": // Look for duplicate media across the project
+		threshold, asYaml, quarantine := dupes.THRESHOLD, false, false
+		for i := 2; i < len(args); i++ {
+			switch args[i] {
+			case "--yaml":
+				asYaml = true
+			case "--quarantine":
+				quarantine = true
+			case "--threshold":
+				i++
+				if i >= len(args) {
+					return fmt.Errorf("Please provide a value for the threshold")
+				}
+				if threshold, err = strconv.Atoi(args[i]); err != nil || threshold < 0 {
+					return fmt.Errorf("Invalid threshold '%s'", args[i])
+				}
+			default:
+				return fmt.Errorf("Unrecognized option '%s'", args[i])
+			}
+		}
+		report, err := dupes.FindDuplicates(cxt, threshold)
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			result = report
+		} else if asYaml {
+			if err = report.Save(stdout); err != nil {
+				return err
+			}
+		} else {
+			for _, group := range report {
+				fmt.Fprintln(out, group)
+			}
+			fmt.Fprintf(out, "Found %d group(s) of duplicates\n", len(report))
+		}
+		if quarantine && len(report) > 0 {
+			fmt.Fprintf(out, "About to move duplicates into '%s'\n", filepath.Join(cxt.Root, context.QUARANTINE))
+			if ok, err := ask(); err != nil {
+				return err
+			} else if ok {
+				return dupes.Quarantine(cxt, report)
+			}
+		}
+
+	case "search": // Search for media by tags and event names
+		from, to, queryParts := time.Time{}, time.Time{}, []string{}
+		for i := 2; i < len(args); i++ {
+			switch args[i] {
+			case "--from", "--to":
+				i++
+				if i >= len(args) {
+					return fmt.Errorf("Please provide a date for '%s'", args[i-1])
+				}
+				date, err := time.ParseInLocation("2006-01-02", args[i], time.Local)
+				if err != nil {
+					return fmt.Errorf("Invalid date '%s'. Expected format YYYY-MM-DD", args[i])
+				}
+				if args[i-1] == "--from" {
+					from = date
+				} else {
+					to = date
+				}
+			default:
+				queryParts = append(queryParts, args[i])
+			}
+		}
+		var query search.Query
+		if len(queryParts) > 0 {
+			if query, err = search.ParseQuery(strings.Join(queryParts, " ")); err != nil {
+				return err
+			}
+		} else if from.IsZero() && to.IsZero() {
+			return fmt.Errorf("Please provide something to search for")
+		}
+		results, err := search.Search(cxt, query, from, to)
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			result = results
+			return nil
+		}
+		for _, result := range results {
+			fmt.Fprintln(out, result.Path)
+		}
+
 	default:
-		fmt.Println("Unrecognized command", args[1])
+		fmt.Fprintln(out, "Unrecognized command", args[1])
 		sendHelp()
 	}
 	return nil
@@ -285,6 +780,10 @@ func main() {
 		return
 	}
 	if err = run(cwd, os.Args); err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(os.Stderr, err)
+		if _, ok := err.(*lock.MissmatchError); ok { // Files have changed. Distinct from failing to check them
+			os.Exit(1)
+		}
+		os.Exit(2)
 	}
 }
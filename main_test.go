@@ -1,30 +1,41 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/internetimagery/photos/backup"
+	"github.com/internetimagery/photos/confirm"
 	"github.com/internetimagery/photos/context"
+	"github.com/internetimagery/photos/dupes"
+	"github.com/internetimagery/photos/journal"
 	"github.com/internetimagery/photos/lock"
 	"github.com/internetimagery/photos/rename"
+	"github.com/internetimagery/photos/sort"
 	"github.com/internetimagery/photos/testutil"
+	yaml "gopkg.in/yaml.v2"
 )
 
 func TestQuestion(t *testing.T) {
 	tu := testutil.NewTestUtil(t)
+	conf := &confirm.Confirm{Mode: confirm.ASK, Output: ioutil.Discard}
+
 	defer tu.UserInput("y\n")()
-	if !question() {
+	if !tu.MustFatal(conf.Ask()).(bool) {
 		tu.Fail("Question did not pass with 'y'")
 	}
 
-	defer tu.UserInput("n\n")
-	if question() {
+	defer tu.UserInput("n\n")()
+	if tu.MustFatal(conf.Ask()).(bool) {
 		tu.Fail("Question passed with 'n'")
 	}
 
-	defer tu.UserInput("anything\n")
-	if question() {
+	defer tu.UserInput("anything\n")()
+	if tu.MustFatal(conf.Ask()).(bool) {
 		tu.Fail("Question passed with something other than 'y' / 'n'")
 	}
 
@@ -213,9 +224,9 @@ func TestRenameExistingSource(t *testing.T) {
 	tu.Must(run(event, []string{"exe", "rename"}))
 
 	tu.AssertExists(
-		filepath.Join(event, rename.SOURCEDIR, "testfile1.txt"),
-		filepath.Join(event, rename.SOURCEDIR, "testfile2.txt"),
-		filepath.Join(event, rename.SOURCEDIR, "testfile2_1.txt"),
+		filepath.Join(event, context.SOURCEDIR, "testfile1.txt"),
+		filepath.Join(event, context.SOURCEDIR, "testfile2.txt"),
+		filepath.Join(event, context.SOURCEDIR, "testfile2_1.txt"),
 	)
 }
 
@@ -234,7 +245,7 @@ func TestRename(t *testing.T) {
 		filepath.Join(event, "event01_002.test"),
 		filepath.Join(event, "event01_002[one two].test"),
 		filepath.Join(event, "event01_003.test"),
-		filepath.Join(event, rename.SOURCEDIR, "newfile.test"),
+		filepath.Join(event, context.SOURCEDIR, "newfile.test"),
 	)
 }
 
@@ -327,3 +338,256 @@ func TestRemoveTag(t *testing.T) {
 	}
 
 }
+
+func TestAddTagSuggestion(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	// Accept suggested spelling
+	event := filepath.Join(tu.Dir, "event01")
+	defer tu.UserInput("y\n")()
+	tu.Must(run(event, []string{"exe", "tag", "2", "alcie"}))
+	tu.AssertExists(filepath.Join(event, "event01_002[alice].txt"))
+
+	// Refuse suggested spelling
+	defer tu.UserInput("n\n")()
+	tu.Must(run(event, []string{"exe", "tag", "3", "alcie"}))
+	tu.AssertExists(filepath.Join(event, "event01_003[alcie].txt"))
+}
+
+func TestAddTagSuggestionUnattended(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	// Tags are kept as typed, without someone to confirm the suggestion
+	event := filepath.Join(tu.Dir, "event01")
+	tu.Must(run(event, []string{"exe", "--yes", "tag", "2", "alcie"}))
+	tu.AssertExists(filepath.Join(event, "event01_002[alcie].txt"))
+	tu.Must(run(event, []string{"exe", "--no-input", "tag", "3", "alcee"}))
+	tu.AssertExists(filepath.Join(event, "event01_003[alcee].txt"))
+}
+
+func TestUndoSort(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	project := filepath.Join(tu.Dir, "project")
+	source := filepath.Join(tu.Dir, "file1.txt")
+	tu.ModTime(2018, 10, 10, source)
+
+	// Sort file into project
+	defer tu.UserInput("y\n")()
+	tu.Must(run(project, []string{"exe", "sort", source}))
+	tu.AssertExists(filepath.Join(project, "Sorted", "18-10-10", "file1.txt"))
+	tu.AssertNotExists(source)
+
+	// Undo puts it back where it came from
+	defer tu.UserInput("y\n")()
+	tu.Must(run(project, []string{"exe", "undo"}))
+	tu.AssertExists(source)
+	tu.AssertNotExists(filepath.Join(project, "Sorted"))
+}
+
+func TestSortDryRun(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	project := filepath.Join(tu.Dir, "project")
+	source := filepath.Join(tu.Dir, "file1.txt")
+	tu.ModTime(2018, 10, 10, source)
+
+	// Test nothing is moved, and nothing needs confirming
+	tu.Must(run(project, []string{"exe", "--dry-run", "sort", source}))
+	tu.AssertExists(source)
+	tu.AssertNotExists(
+		filepath.Join(project, "Sorted"),
+		filepath.Join(project, journal.JOURNALFILE),
+	)
+}
+
+func TestRenameDryRun(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	event := filepath.Join(tu.Dir, "event01")
+
+	// Test flag is picked up anywhere, and nothing is renamed
+	tu.Must(run(event, []string{"exe", "rename", "--dry-run"}))
+	tu.AssertExists(filepath.Join(event, "newfile.test"))
+	tu.AssertNotExists(
+		filepath.Join(event, "event01_003.test"),
+		filepath.Join(event, context.SOURCEDIR),
+		filepath.Join(event, rename.PROGRESSFILE),
+	)
+}
+
+func TestSortUnattended(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	project := filepath.Join(tu.Dir, "project")
+	source := filepath.Join(tu.Dir, "file1.txt")
+	tu.ModTime(2018, 10, 10, source)
+	dest := filepath.Join(project, "Sorted", "18-10-10", "file1.txt")
+
+	// Test no input fails rather than asking, even if there is input to be read
+	defer tu.UserInput("y\n")()
+	if err := run(project, []string{"exe", "--no-input", "sort", source}); err != confirm.ErrNoInput {
+		tu.Fail("Expected no input error", err)
+	}
+	tu.AssertExists(source)
+
+	// Test environment is used when no flag is given
+	os.Setenv(confirm.ENV, confirm.NOINPUT)
+	defer os.Unsetenv(confirm.ENV)
+	if err := run(project, []string{"exe", "sort", source}); err != confirm.ErrNoInput {
+		tu.Fail("Expected no input error from environment", err)
+	}
+	tu.AssertExists(source)
+
+	// Test yes sorts without asking. Overriding the environment
+	tu.Must(run(project, []string{"exe", "sort", "--yes", source}))
+	tu.AssertExists(dest)
+	tu.AssertNotExists(source)
+}
+
+func TestSortJSON(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	project := filepath.Join(tu.Dir, "project")
+	source := filepath.Join(tu.Dir, "file1.txt")
+	tu.ModTime(2018, 10, 10, source)
+	dest := filepath.Join(project, "Sorted", "18-10-10", "file1.txt")
+
+	output := new(bytes.Buffer)
+	defer func() { stdout = os.Stdout }()
+	stdout = output
+
+	// Test the files sorted are written out, and nothing else
+	tu.Must(run(project, []string{"exe", "--json", "--yes", "sort", source}))
+	result := new(sort.Result)
+	tu.MustFatal(json.Unmarshal(output.Bytes(), result))
+	if result.Sorted[source] != dest {
+		tu.FailE(dest, result.Sorted[source])
+	}
+	tu.AssertExists(dest)
+}
+
+func TestLockJSON(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	event := filepath.Join(tu.Dir, "event01")
+	output := new(bytes.Buffer)
+	defer func() { stdout = os.Stdout }()
+	stdout = output
+
+	// Test mismatches are written out, along with the error
+	if _, ok := run(event, []string{"exe", "--json", "lock"}).(*lock.MissmatchError); !ok {
+		tu.Fail("Allowed missmatch lock")
+	}
+	results := lock.Results{}
+	tu.MustFatal(json.Unmarshal(output.Bytes(), &results))
+	states := map[string]string{}
+	for _, result := range results {
+		states[result.Path] = result.State
+	}
+	if state := states[filepath.Join(event, "event01_001.txt")]; state != lock.SIZECHANGED {
+		tu.FailE(lock.SIZECHANGED, state)
+	}
+	if state := states[filepath.Join(event, "event01_002.txt")]; state != lock.NEW {
+		tu.FailE(lock.NEW, state)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	event := filepath.Join(tu.Dir, "event01")
+	if err, ok := run(event, []string{"exe", "verify"}).(*lock.MissmatchError); !ok {
+		tu.Fail("Missed changed file", err)
+	}
+	tu.Must(run(event, []string{"exe", "lock", "--force"}))
+	tu.Must(run(event, []string{"exe", "verify"}))
+	tu.Must(run(tu.Dir, []string{"exe", "verify", "--recursive"}))
+	if err := run(filepath.Join(tu.Dir, "event02"), []string{"exe", "verify"}); err == nil {
+		tu.Fail("Verified event that was not locked")
+	}
+}
+
+func TestBackupStatus(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	event := filepath.Join(tu.Dir, "event01")
+	output := new(bytes.Buffer)
+	defer func() { stdout = os.Stdout }()
+	stdout = output
+
+	tu.MustFatal(run(event, []string{"exe", "--yes", "backup", "a"}))
+	output.Reset()
+	tu.MustFatal(run(tu.Dir, []string{"exe", "--json", "backup", "status"}))
+	statuses := []*backup.Status{}
+	tu.MustFatal(json.Unmarshal(output.Bytes(), &statuses))
+	if len(statuses) != 1 || statuses[0].Event != "event01" || !statuses[0].BackedUp || statuses[0].Changed {
+		tu.Fail("Expected event01 to be backed up. Got", statuses)
+	}
+}
+
+func TestRestoreEvent(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	event := filepath.Join(tu.Dir, "event01")
+	tu.MustFatal(run(event, []string{"exe", "lock", "--force"}))
+	tu.Must(run(tu.Dir, []string{"exe", "--yes", "restore", "nas", "event01"}))
+
+	// Only events within the project, and outside the sorted directory, can be restored
+	outside := tu.MustFatal(ioutil.TempDir("", "outside")).(string)
+	defer os.RemoveAll(outside)
+	sorted := filepath.Join(tu.Dir, "Sorted", "event02")
+	for _, dir := range []string{outside, sorted} {
+		tu.MustFatal(os.MkdirAll(dir, 0755))
+		tu.MustFatal(ioutil.WriteFile(filepath.Join(dir, lock.LOCKFILENAME), []byte("{}\n"), 0644))
+		if err := run(tu.Dir, []string{"exe", "--yes", "restore", "nas", dir}); err == nil {
+			tu.Fail("Allowed restore into", dir)
+		}
+	}
+}
+
+func TestDupesYAML(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	output := new(bytes.Buffer)
+	defer func() { stdout = os.Stdout }()
+	stdout = output
+
+	tu.MustFatal(run(tu.Dir, []string{"exe", "dupes", "--threshold", "0", "--yaml"}))
+	report := dupes.Report{}
+	tu.MustFatal(yaml.Unmarshal(output.Bytes(), &report))
+	if len(report) != 1 || report[0].Keep != "event01/event01_001.txt" {
+		tu.Fail("Expected one exact group. Got", report)
+	}
+}
+
+func TestUndoTags(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	event := filepath.Join(tu.Dir, "event01")
+	tu.MustFatal(run(event, []string{"exe", "lock"}))
+
+	// Rename a tag, then undo it. The lock should be put back along with the files
+	tu.MustFatal(run(tu.Dir, []string{"exe", "--yes", "tags", "rename", "alcie", "alice"}))
+	tu.AssertExists(filepath.Join(event, "event01_001[alice bob].txt"))
+	tu.MustFatal(run(tu.Dir, []string{"exe", "--yes", "undo"}))
+	tu.AssertExists(filepath.Join(event, "event01_001[alcie bob].txt"), filepath.Join(event, "event01_002[alcie].txt"))
+	lockmap := tu.MustFatal(lock.ReadLockFile(event)).(lock.LockMap)
+	if _, ok := lockmap["event01_001[alcie bob].txt"]; !ok {
+		tu.Fail("Lock was not put back. Got", lockmap)
+	}
+	tu.Must(run(event, []string{"exe", "verify"}))
+}
@@ -0,0 +1,185 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IsTerminal : Check if file is an interactive terminal (rather than a pipe or file)
+func IsTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// FormatBytes : Human readable size. ie 1.5MB
+func FormatBytes(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value, unit := float64(size), 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
+
+// Reporter : Report how far along a long running operation is. Files and bytes done, throughput and time remaining.
+// On a terminal a single line is kept updated (with log output printed above it), otherwise a log line is written per file.
+// A nil Reporter is valid, and reports nothing.
+type Reporter struct {
+	Name       string    // Operation being reported, ie "sort"
+	Output     io.Writer // Where the updating line is drawn (terminal only)
+	Terminal   bool      // Draw a single updating line, rather than logging each file
+	files      int       // Files done
+	bytes      int64     // Bytes done
+	totalFiles int       // Files expected
+	totalBytes int64     // Bytes expected
+	status     string    // What is happening right now
+	start      time.Time
+	lineLength int       // Length of last line drawn, so it can be cleared
+	logOutput  io.Writer // Log output, before we took over
+	clock      func() time.Time
+	lock       sync.Mutex
+}
+
+// Output : Where new reporters draw their line. Swappable, ie to stderr to keep stdout clear for JSON results
+var Output = os.Stdout
+
+// NewReporter : Start reporting an operation. Draws to Output if it is a terminal, otherwise logs.
+// While drawing, log output is routed through the reporter so it does not trample the line. Call Close when done.
+func NewReporter(name string) *Reporter {
+	report := &Reporter{Name: name, Output: Output, Terminal: IsTerminal(Output), clock: time.Now}
+	report.start = report.clock()
+	if report.Terminal {
+		report.logOutput = log.Writer()
+		log.SetOutput(report)
+	}
+	return report
+}
+
+// Expect : Add to the work expected to be done
+func (report *Reporter) Expect(files int, bytes int64) {
+	if report == nil {
+		return
+	}
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	report.totalFiles += files
+	report.totalBytes += bytes
+	report.draw()
+}
+
+// Status : Report what is being done right now. ie "Copying", "IMG_0001.JPG"
+func (report *Reporter) Status(status, filename string) {
+	if report == nil {
+		return
+	}
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	report.status = status + " " + filepath.Base(filename)
+	report.draw()
+}
+
+// Done : Report a file as finished
+func (report *Reporter) Done(filename string, bytes int64) {
+	if report == nil {
+		return
+	}
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	report.files++
+	report.bytes += bytes
+	if report.Terminal {
+		report.draw()
+		return
+	}
+	log.Printf("Progress: %s files=%d/%d bytes=%d/%d rate=%s/s eta=%s file=%q\n",
+		report.Name, report.files, report.totalFiles, report.bytes, report.totalBytes, FormatBytes(report.rate()), report.eta(), filename)
+}
+
+// Close : Finish reporting, with a summary of what was done. Log output is handed back
+func (report *Reporter) Close() {
+	if report == nil {
+		return
+	}
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	elapsed := report.clock().Sub(report.start).Round(time.Second)
+	summary := fmt.Sprintf("%s: %d files, %s in %s (%s/s)", report.Name, report.files, FormatBytes(report.bytes), elapsed, FormatBytes(report.rate()))
+	if !report.Terminal {
+		log.Println("Finished:", summary)
+		return
+	}
+	report.clear()
+	fmt.Fprintln(report.Output, summary)
+	log.SetOutput(report.logOutput)
+	report.Terminal = false
+}
+
+// Write : Print log output above the updating line
+func (report *Reporter) Write(data []byte) (int, error) {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	report.clear()
+	n, err := report.logOutput.Write(data)
+	report.draw()
+	return n, err
+}
+
+// rate : Bytes per second so far
+func (report *Reporter) rate() int64 {
+	elapsed := report.clock().Sub(report.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(report.bytes) / elapsed)
+}
+
+// eta : Estimated time remaining, based on bytes (or files if sizes are unknown) done so far
+func (report *Reporter) eta() string {
+	done, total := float64(report.bytes), float64(report.totalBytes)
+	if total <= 0 {
+		done, total = float64(report.files), float64(report.totalFiles)
+	}
+	if total <= 0 || done <= 0 {
+		return "unknown"
+	} else if done >= total {
+		return "0s"
+	}
+	elapsed := report.clock().Sub(report.start)
+	return (time.Duration(float64(elapsed) * (total - done) / done)).Round(time.Second).String()
+}
+
+// draw : Redraw the updating line
+func (report *Reporter) draw() {
+	if !report.Terminal {
+		return
+	}
+	line := fmt.Sprintf("%s: %d/%d files, %s/%s, %s/s, %s left",
+		report.Name, report.files, report.totalFiles, FormatBytes(report.bytes), FormatBytes(report.totalBytes), FormatBytes(report.rate()), report.eta())
+	if report.status != "" {
+		line += " - " + report.status
+	}
+	padding := ""
+	if len(line) < report.lineLength {
+		padding = strings.Repeat(" ", report.lineLength-len(line))
+	}
+	fmt.Fprint(report.Output, "\r"+line+padding)
+	report.lineLength = len(line)
+}
+
+// clear : Remove the updating line, so something else can be printed
+func (report *Reporter) clear() {
+	if report.lineLength > 0 {
+		fmt.Fprint(report.Output, "\r"+strings.Repeat(" ", report.lineLength)+"\r")
+		report.lineLength = 0
+	}
+}
@@ -0,0 +1,151 @@
+package progress
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock : Clock that only moves when told to
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+func (clock *fakeClock) Tick() {
+	clock.now = clock.now.Add(time.Second)
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:                       "0B",
+		1023:                    "1023B",
+		1024:                    "1.0KB",
+		1536:                    "1.5KB",
+		5 * 1024 * 1024:         "5.0MB",
+		60 * 1024 * 1024 * 1024: "60.0GB",
+	}
+	for size, expect := range tests {
+		if result := FormatBytes(size); result != expect {
+			t.Log("Expected", expect)
+			t.Log("Got", result)
+			t.Fail()
+		}
+	}
+}
+
+func TestReporterNil(t *testing.T) {
+	var report *Reporter // Should all do nothing
+	report.Expect(1, 10)
+	report.Status("Copying", "file.txt")
+	report.Done("file.txt", 10)
+	report.Close()
+}
+
+func TestReporterLog(t *testing.T) {
+	logs := new(bytes.Buffer)
+	defer log.SetOutput(os.Stderr)
+	log.SetOutput(logs)
+
+	clock := new(fakeClock)
+	report := &Reporter{Name: "test", clock: clock.Now}
+	report.Expect(2, 2048)
+	report.Status("Copying", "/path/to/one.txt")
+	clock.Tick()
+	report.Done("/path/to/one.txt", 1024)
+	clock.Tick()
+	report.Done("/path/to/two.txt", 1024)
+	report.Close()
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 3 {
+		t.Log("Expected a line per file and a summary. Got", lines)
+		t.FailNow()
+	}
+	if expect := `Progress: test files=1/2 bytes=1024/2048 rate=1.0KB/s eta=1s file="/path/to/one.txt"`; !strings.HasSuffix(lines[0], expect) {
+		t.Log("Expected", expect)
+		t.Log("Got", lines[0])
+		t.Fail()
+	}
+	if expect := "eta=0s"; !strings.Contains(lines[1], expect) {
+		t.Log("Expected", expect)
+		t.Log("Got", lines[1])
+		t.Fail()
+	}
+	if expect := "Finished: test: 2 files, 2.0KB in "; !strings.Contains(lines[2], expect) {
+		t.Log("Expected", expect)
+		t.Log("Got", lines[2])
+		t.Fail()
+	}
+}
+
+func TestReporterTerminal(t *testing.T) {
+	output, logs := new(bytes.Buffer), new(bytes.Buffer)
+	clock := new(fakeClock)
+	report := &Reporter{Name: "test", Output: output, Terminal: true, logOutput: logs, clock: clock.Now}
+	report.Expect(2, 2048)
+	report.Status("Copying", "/path/to/one.txt")
+
+	// Test line is kept updated in place
+	line := output.String()[strings.LastIndex(output.String(), "\r")+1:]
+	if expect := "test: 0/2 files, 0B/2.0KB, 0B/s, unknown left - Copying one.txt"; line != expect {
+		t.Log("Expected", expect)
+		t.Log("Got", line)
+		t.Fail()
+	}
+	clock.Tick()
+	report.Done("/path/to/one.txt", 1024)
+	if strings.Contains(output.String(), "\n") {
+		t.Log("Line was not updated in place", output.String())
+		t.Fail()
+	}
+
+	// Test log output is printed separately, and the line drawn again after
+	report.Write([]byte("Copying: one.txt\n"))
+	if logs.String() != "Copying: one.txt\n" {
+		t.Log("Expected", "Copying: one.txt\n")
+		t.Log("Got", logs.String())
+		t.Fail()
+	}
+	if !strings.HasSuffix(strings.TrimRight(output.String(), " "), "- Copying one.txt") {
+		t.Log("Line was not drawn again", output.String())
+		t.Fail()
+	}
+
+	// Test closing leaves a summary behind
+	report.Close()
+	if !strings.HasPrefix(output.String()[strings.LastIndex(output.String(), "\r")+1:], "test: 1 files, 1.0KB in ") {
+		t.Log("Missing summary", output.String())
+		t.Fail()
+	}
+}
+
+func TestReporterOutput(t *testing.T) {
+	handle, err := ioutil.TempFile("", "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(handle.Name())
+	defer handle.Close()
+	defer func(output *os.File) { Output = output }(Output)
+	Output = handle
+
+	// Test reporters draw to wherever output is pointed, if it is a terminal
+	report := NewReporter("test")
+	defer report.Close()
+	if report.Output != handle {
+		t.Log("Reporter is not drawing to the chosen output")
+		t.Fail()
+	}
+	if report.Terminal {
+		t.Log("A file was taken for a terminal")
+		t.Fail()
+	}
+}
@@ -1,8 +1,12 @@
 package rename
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"image"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -13,10 +17,135 @@ import (
 
 	"github.com/internetimagery/photos/format"
 	"github.com/internetimagery/photos/lock"
+	"github.com/internetimagery/photos/progress"
+	yaml "gopkg.in/yaml.v2"
 )
 
-// SOURCEDIR : File to store originals for manual checking
-const SOURCEDIR = "Source Media - Please check before removing"
+// PROGRESSFILE : Record of renames in progress. Only left behind if a rename was interrupted (ie power outage)
+var PROGRESSFILE = format.TEMPPREFIX + "rename-progress.yaml"
+
+// Progress : Files involved in a single rename
+type Progress struct {
+	Source   string `yaml:"source"`   // Original file (relative to event)
+	Dest     string `yaml:"dest"`     // Formatted (and compressed) file (relative to event)
+	Temp     string `yaml:"temp"`     // Working file, before it becomes Dest (relative to event)
+	Original string `yaml:"original"` // Location in source folder where Source is moved when done (relative to event)
+}
+
+// Recover : Clean up after a rename that was interrupted (or failed). Renames that completed are finished off, the rest are rolled back
+func Recover(cxt *context.Context) error {
+	interrupted, err := recoverProgress(cxt)
+	if err != nil {
+		return err
+	}
+	return removeLeftovers(cxt, interrupted)
+}
+
+// recoverProgress : Finish off or roll back the renames recorded in the progress file. Returns true if there was a progress file to recover from
+func recoverProgress(cxt *context.Context) (bool, error) {
+	progressPath := filepath.Join(cxt.WorkingDir, PROGRESSFILE)
+	data, err := ioutil.ReadFile(progressPath)
+	if os.IsNotExist(err) { // Nothing to recover
+		return false, nil
+	} else if err != nil {
+		return true, err
+	}
+	progress := []*Progress{}
+	if err = yaml.Unmarshal(data, &progress); err != nil {
+		return true, err
+	}
+
+	log.Println("Recovering from interrupted rename...")
+	for _, prog := range progress {
+		prog.Source = filepath.Join(cxt.WorkingDir, filepath.FromSlash(prog.Source))
+		prog.Dest = filepath.Join(cxt.WorkingDir, filepath.FromSlash(prog.Dest))
+		prog.Temp = filepath.Join(cxt.WorkingDir, filepath.FromSlash(prog.Temp))
+		prog.Original = filepath.Join(cxt.WorkingDir, filepath.FromSlash(prog.Original))
+		srcInfo, err := os.Stat(prog.Source)
+		if os.IsNotExist(err) { // Source already moved. This one finished
+			continue
+		} else if err != nil {
+			return true, err
+		}
+
+		// Check how far along we got. Once the temp file is moved into place, we're complete
+		_, tempErr := os.Stat(prog.Temp)
+		if tempErr != nil && !os.IsNotExist(tempErr) {
+			return true, tempErr
+		}
+		destInfo, destErr := os.Stat(prog.Dest)
+		if destErr != nil && !os.IsNotExist(destErr) {
+			return true, destErr
+		}
+		complete := os.IsNotExist(tempErr) && destErr == nil && (destInfo.Size() > 0 || srcInfo.Size() == 0)
+
+		if complete {
+			log.Println("Finishing:", prog.Source)
+			if err = cxt.Journal.Create(prog.Dest); err != nil {
+				return true, err
+			}
+			if err = cxt.Journal.Move(prog.Source, sort.UniqueName(prog.Original)); err != nil {
+				return true, err
+			}
+			continue
+		}
+
+		log.Println("Rolling back:", prog.Source)
+		if tempErr == nil {
+			if err = os.Remove(prog.Temp); err != nil {
+				return true, err
+			}
+		}
+		if destErr == nil && destInfo.Size() == 0 { // Only remove our placeholder. Never real media.
+			if err = os.Remove(prog.Dest); err != nil {
+				return true, err
+			}
+		}
+	}
+	return true, os.Remove(progressPath)
+}
+
+// removeLeftovers : Remove working (temp) files left behind by a rename, that the progress file did not account for.
+// Empty placeholders are removed too if a rename was interrupted (a progress file or working files were found), as empty media is otherwise left alone. Locked media is never touched
+func removeLeftovers(cxt *context.Context, interrupted bool) error {
+	files, err := ioutil.ReadDir(cxt.WorkingDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !file.IsDir() && format.IsTempPath(file.Name()) {
+			interrupted = true
+		}
+	}
+	lockmap, err := lock.ReadLockFile(cxt.WorkingDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	eventName := filepath.Base(cxt.WorkingDir)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		filename := filepath.Join(cxt.WorkingDir, file.Name())
+		if format.IsTempPath(filename) {
+			log.Println("Removing leftover:", filename)
+			if err = os.Remove(filename); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, ok := lockmap[file.Name()]; ok || file.Size() != 0 || !interrupted {
+			continue
+		}
+		if media := format.NewMedia(filename); media.Index > 0 && media.Event == eventName { // Placeholder, never filled
+			log.Println("Removing placeholder:", filename)
+			if err = os.Remove(filename); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
 // setEnvironment : Set up environment variables for the command context
 func setEnvironment(sourcePath, destPath string, cxt *context.Context) {
@@ -27,18 +156,27 @@ func setEnvironment(sourcePath, destPath string, cxt *context.Context) {
 }
 
 // Rename : Rename and compress files within an event (directory). Optionally compress while renaming.
-func Rename(cxt *context.Context, compress bool) error {
+// Returns the files renamed (or to be renamed, on a dry run), mapped to their new names.
+func Rename(cxt *context.Context, compress bool) (map[string]string, error) {
+	renamed := map[string]string{}
+
+	// Clean up anything left behind from an interrupted rename
+	if !cxt.Journal.IsDryRun() {
+		if err := Recover(cxt); err != nil {
+			return renamed, err
+		}
+	}
 
 	// Get event name from path
 	eventName := filepath.Base(cxt.WorkingDir)
 
 	// Get source path
-	sourcePath := filepath.Join(cxt.WorkingDir, SOURCEDIR)
+	sourcePath := filepath.Join(cxt.WorkingDir, context.SOURCEDIR)
 
 	// Grab files from given path
 	mediaList, err := format.GetMediaFromDirectory(cxt.WorkingDir)
 	if err != nil {
-		return err
+		return renamed, err
 	}
 
 	// Get max index
@@ -49,122 +187,267 @@ func Rename(cxt *context.Context, compress bool) error {
 		}
 	}
 
-	// Map old names to new names
-	renameMap := make(map[string]string)
-	// Map renames to source
-	sourceMap := make(map[string]string)
-	for _, media := range mediaList {
-		if media.Index == 0 { // Media is not already named correctly
-			maxIndex++
+	// Work out new names, in order. Media that belongs together (ie sidecars) shares an index
+	jobs := []*Progress{}
+	for _, group := range format.GroupMedia(mediaList) {
+		if group[0].Index != 0 { // Media is already named correctly
+			continue
+		}
+		maxIndex++
+		for _, media := range group {
 			media.Index = maxIndex
 			media.Event = eventName
 			newName, err := media.FormatName()
 			if err != nil {
-				return err
+				return renamed, err
 			}
-			renameMap[media.Path] = filepath.Join(cxt.WorkingDir, newName)
-			sourceMap[media.Path] = filepath.Join(sourcePath, filepath.Base(media.Path))
+			jobs = append(jobs, &Progress{
+				Source:   media.Path,
+				Dest:     filepath.Join(cxt.WorkingDir, newName),
+				Temp:     format.MakeTempPath(media.Path), // Temporary file to create before calling it complete.
+				Original: filepath.Join(sourcePath, filepath.Base(media.Path))})
 		}
 	}
 
 	// Make sure we actually have something to do
-	if len(renameMap) == 0 {
+	if len(jobs) == 0 {
 		log.Println("Nothing to rename...")
-		return nil
+		return renamed, nil
+	}
+
+	// Only report what would happen on a dry run
+	if cxt.Journal.IsDryRun() {
+		for _, job := range jobs {
+			renamed[job.Source] = job.Dest
+		}
+		return renamed, planRename(cxt, jobs, compress)
 	}
 
 	//////////// Now make some changes! /////////////
 
 	// Make source file directory if it doesn't exist
-	if err = os.Mkdir(sourcePath, 0755); err != nil && !os.IsExist(err) {
-		return err
+	if err = cxt.Journal.Mkdir(sourcePath, 0755); err != nil && !os.IsExist(err) {
+		return renamed, err
 	}
 
-	// Run through files!
-	// TODO: Make this happen in parallel
-	for src, dest := range renameMap {
-		tempDest := format.MakeTempPath(src) // Temporary file to create before calling it complete.
-
-		log.Println("Renaming:", src)
-
-		// Create a placeholder file to lock in the spot
-		handle, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	// Keep a record of what we're about to do, so we can recover if interrupted. Not needed if we exit normally.
+	records := []*Progress{}
+	relPath := func(filename string) string {
+		relpath, err := filepath.Rel(cxt.WorkingDir, filename)
 		if err != nil {
-			return err
+			panic(err) // Paths all come from within the working dir. This should never fail!
 		}
+		return filepath.ToSlash(relpath)
+	}
+	for _, job := range jobs {
+		records = append(records, &Progress{
+			Source:   relPath(job.Source),
+			Dest:     relPath(job.Dest),
+			Temp:     relPath(job.Temp),
+			Original: relPath(job.Original)})
+	}
+	data, err := yaml.Marshal(records)
+	if err != nil {
+		return renamed, err
+	}
+	progressPath := filepath.Join(cxt.WorkingDir, PROGRESSFILE)
+	handle, err := os.Create(progressPath)
+	if err != nil {
+		return renamed, err
+	}
+	if _, err = handle.Write(data); err != nil {
 		handle.Close()
-		defer func() { // Cleanup
-			if err != nil {
-				os.Remove(dest)
+		return renamed, err
+	}
+	if err = handle.Sync(); err != nil { // Make sure this hits the disk before we start
+		handle.Close()
+		return renamed, err
+	}
+	if err = handle.Close(); err != nil {
+		return renamed, err
+	}
+
+	// Keep track of how far along we are
+	report := progress.NewReporter("rename")
+	defer report.Close()
+	sizes := make([]int64, len(jobs))
+	for i, job := range jobs {
+		info, err := os.Stat(job.Source)
+		if err != nil {
+			return renamed, err
+		}
+		sizes[i] = info.Size()
+		report.Expect(1, sizes[i])
+	}
+
+	// Run through files, a few at a time! Each job logs to its own buffer so output remains in order.
+	workers := cxt.Config.CompressWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	queue := make(chan int)
+	stop := make(chan struct{})
+	results := make([]chan error, len(jobs))
+	logs := make([]*bytes.Buffer, len(jobs))
+	for i := range jobs {
+		results[i] = make(chan error, 1)
+		logs[i] = new(bytes.Buffer)
+	}
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range queue {
+				report.Status("Renaming", jobs[i].Source)
+				results[i] <- renameFile(cxt, jobs[i], compress, log.New(logs[i], log.Prefix(), log.Flags()))
 			}
 		}()
+	}
+	go func() { // Hand out jobs until we run out, or are asked to stop
+		defer close(queue)
+		for i := 0; i < len(jobs); i++ {
+			select {
+			case queue <- i:
+			case <-stop:
+				for ; i < len(jobs); i++ {
+					results[i] <- errSkipped
+				}
+				return
+			}
+		}
+	}()
 
-		// Create environment for command
-		setEnvironment(src, tempDest, cxt)
+	// Collect results in order. Stop handing out new jobs on the first error
+	stopped := false
+	for i := range jobs {
+		jobErr := <-results[i]
+		_, copyErr := io.Copy(log.Writer(), logs[i])
+		if jobErr == nil {
+			renamed[jobs[i].Source] = jobs[i].Dest
+			report.Done(jobs[i].Source, sizes[i])
+		} else if jobErr != errSkipped && err == nil { // Keep the first error
+			err = jobErr
+		}
+		if copyErr != nil && err == nil {
+			err = copyErr
+		}
+		if err != nil && !stopped {
+			stopped = true
+			close(stop)
+		}
+	}
+	if err != nil { // Leave our progress behind, so the next rename can clean up
+		return renamed, err
+	}
+	return renamed, os.Remove(progressPath)
+}
 
+// planRename : Report the renames (and compress commands) that would be run, without running them
+func planRename(cxt *context.Context, jobs []*Progress, compress bool) error {
+	for _, job := range jobs {
+		log.Println("Renaming:", job.Source, "--->", job.Dest)
 		if compress {
-
-			// Grab compress command or use a default command. Do the compression.
-			command := cxt.Config.Compress.GetCommand(src)
-			if command == "" {
-				// We have no command. Just copy the file across directly
-				log.Println("Copying:", src)
-				if err = <-copy.File(src, tempDest); err != nil {
-					return err
-				}
-			} else {
-				// We have a command. Prep and execute it.
-				log.Println("Compressing:", src)
-				com, err := cxt.PrepCommand(command)
+			jobCxt := cxt.Copy()
+			setEnvironment(job.Source, job.Temp, jobCxt)
+			if command := jobCxt.Config.Compress.GetCommand(job.Source); command != "" {
+				com, err := jobCxt.PrepCommand(command)
 				if err != nil {
 					return err
 				}
 				log.Println("Running:", com.Args)
-				if err = com.Run(); err != nil {
-					return err
-				}
+			}
+		}
+		log.Println("Moving:", job.Source, "--->", job.Original)
+	}
+	return nil
+}
+
+// errSkipped : Job was not run, as an earlier job failed
+var errSkipped = errors.New("skipped")
+
+// renameFile : Rename (and compress) a single file. Cleaning up after itself if anything fails
+func renameFile(cxt *context.Context, job *Progress, compress bool, logger *log.Logger) (err error) {
+	src, dest, tempDest := job.Source, job.Dest, job.Temp
+
+	logger.Println("Renaming:", src)
+
+	// Create a placeholder file to lock in the spot
+	handle, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	handle.Close()
+	defer func() { // Cleanup our placeholder, and anything left half done
+		if err != nil {
+			os.Remove(tempDest)
+			os.Remove(dest)
+		}
+	}()
+
+	// Create environment for command. Each job gets its own, as they run side by side
+	cxt = cxt.Copy()
+	setEnvironment(src, tempDest, cxt)
+
+	if compress {
+
+		// Grab compress command or use a default command. Do the compression.
+		command := cxt.Config.Compress.GetCommand(src)
+		if command == "" {
+			// We have no command. Just copy the file across directly
+			logger.Println("Copying:", src)
+			if err = <-copy.File(src, tempDest); err != nil {
+				return err
+			}
+		} else {
+			// We have a command. Prep and execute it.
+			logger.Println("Compressing:", src)
+			com, err := cxt.PrepCommand(command)
+			if err != nil {
+				return err
+			}
+			logger.Println("Running:", com.Args)
+			if err = com.Run(); err != nil {
+				return err
+			}
 
-				// Verify file made it to its location and it matches
-				desthandle, err := os.Open(tempDest)
+			// Verify file made it to its location and it matches
+			desthandle, err := os.Open(tempDest)
+			if err != nil {
+				return err
+			}
+			desthash, err := lock.GeneratePerceptualHash("difference", desthandle)
+			desthandle.Close()
+			if err == nil {
+				srchandle, err := os.Open(src)
 				if err != nil {
 					return err
 				}
-				desthash, err := lock.GeneratePerceptualHash("difference", desthandle)
-				desthandle.Close()
+				srchash, err := lock.GeneratePerceptualHash("difference", srchandle)
+				srchandle.Close()
 				if err == nil {
-					srchandle, err := os.Open(src)
-					if err != nil {
-						return err
-					}
-					srchash, err := lock.GeneratePerceptualHash("difference", srchandle)
-					srchandle.Close()
-					if err == nil {
-						if issame, err := lock.IsSamePerceptualHash(desthash, srchash); err == nil && !issame {
-							return fmt.Errorf("Compressed image does not match source '%s", src)
-						}
+					if issame, err := lock.IsSamePerceptualHash(desthash, srchash); err == nil && !issame {
+						return fmt.Errorf("Compressed image does not match source '%s", src)
 					}
 				}
-				if err != nil && err != image.ErrFormat {
-					return err
-				}
 			}
-		} else {
-			// We asked not to compress the file. Just copy it instead
-			log.Println("Copying:", src)
-			if err = <-copy.File(src, tempDest); err != nil {
+			if err != nil && err != image.ErrFormat {
 				return err
 			}
 		}
-
-		// Move file to its correct location
-		if err = os.Rename(tempDest, dest); err != nil {
+	} else {
+		// We asked not to compress the file. Just copy it instead
+		logger.Println("Copying:", src)
+		if err = <-copy.File(src, tempDest); err != nil {
 			return err
 		}
+	}
 
-		// Move source file to source folder.
-		if err = os.Rename(src, sort.UniqueName(sourceMap[src])); err != nil {
-			return err
-		}
+	// Move file to its correct location
+	if err = copy.Move(tempDest, dest); err != nil {
+		return err
 	}
-	return nil
+	if err = cxt.Journal.Create(dest); err != nil {
+		return err
+	}
+
+	// Move source file to source folder.
+	return cxt.Journal.Move(src, sort.UniqueName(job.Original))
 }
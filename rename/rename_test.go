@@ -1,11 +1,15 @@
 package rename
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"runtime"
 	"testing"
 
 	"github.com/internetimagery/photos/context"
+	"github.com/internetimagery/photos/lock"
 	"github.com/internetimagery/photos/testutil"
 )
 
@@ -51,6 +55,50 @@ func TestRenameNoNew(t *testing.T) {
 	)
 }
 
+func TestRenameSidecars(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	// Get context
+	event := filepath.Join(tu.Dir, "event01")
+	cxt := tu.MustFatal(context.NewContext(event)).(*context.Context)
+
+	// Perform rename without compression
+	tu.Must(Rename(cxt, false))
+
+	// Sidecars and RAW+JPEG pairs share an index
+	tu.AssertExists(
+		filepath.Join(event, "event01_001.jpg"),
+		filepath.Join(event, "event01_002.jpg"),
+		filepath.Join(event, "event01_002.xmp"),
+		filepath.Join(event, "event01_003.cr2"),
+		filepath.Join(event, "event01_003.jpg"),
+		filepath.Join(event, "event01_004.jpg"),
+		filepath.Join(event, "event01_004.xmp"),
+	)
+	tu.AssertNotExists(filepath.Join(event, "event01_005.jpg"))
+}
+
+func TestRenameParallel(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	// Get context
+	event := filepath.Join(tu.Dir, "event01")
+	cxt := tu.MustFatal(context.NewContext(event)).(*context.Context)
+
+	// Perform rename across a few workers
+	tu.Must(Rename(cxt, true))
+
+	// Indices should follow the original order, regardless of which finished first
+	for i, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		data := tu.MustFatal(ioutil.ReadFile(filepath.Join(event, fmt.Sprintf("event01_%03d.txt", i+1)))).([]byte)
+		if expect := "content " + name + "\n"; string(data) != expect {
+			tu.FailE(expect, string(data))
+		}
+	}
+}
+
 func TestRenameCompressCheck(t *testing.T) {
 	tu := testutil.NewTestUtil(t)
 	defer tu.LoadTestdata()()
@@ -80,11 +128,164 @@ func TestRenameCompressCheck(t *testing.T) {
 	}
 
 	// Perform rename with compression
-	if err := Rename(cxt, true); err == nil {
+	if _, err := Rename(cxt, true); err == nil {
 		tu.Fail("Allowed corrupt image from third party compression")
 	}
 }
 
+func TestRecover(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	event := filepath.Join(tu.Dir, "event01")
+	source := filepath.Join(event, context.SOURCEDIR)
+	cxt := tu.MustFatal(context.NewContext(event)).(*context.Context)
+
+	// Lock should refuse to snapshot placeholders
+	if _, err := lock.LockEvent(cxt, event, false); err == nil {
+		tu.Fail("Allowed locking interrupted rename")
+	}
+
+	tu.Must(Recover(cxt))
+
+	// Completed renames are finished
+	tu.AssertExists(
+		filepath.Join(event, "event01_001.jpg"),
+		filepath.Join(source, "done.jpg"),
+		filepath.Join(event, "event01_004.jpg"),
+		filepath.Join(source, "finished.jpg"),
+	)
+	tu.AssertNotExists(filepath.Join(event, "done.jpg"))
+
+	// Incomplete renames are rolled back
+	tu.AssertExists(
+		filepath.Join(event, "partial.jpg"),
+		filepath.Join(event, "started.jpg"),
+	)
+	tu.AssertNotExists(
+		filepath.Join(event, "event01_002.jpg"),
+		filepath.Join(event, "tmp-partial.jpg"),
+		filepath.Join(event, "event01_003.jpg"),
+		filepath.Join(event, PROGRESSFILE),
+	)
+
+	// Nothing left to recover
+	tu.Must(Recover(cxt))
+	tu.Must(lock.LockEvent(cxt, event, false))
+}
+
+func TestRenameRecover(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	event := filepath.Join(tu.Dir, "event01")
+	cxt := tu.MustFatal(context.NewContext(event)).(*context.Context)
+
+	// Rename picks up where it left off
+	tu.Must(Rename(cxt, true))
+	tu.AssertExists(
+		filepath.Join(event, "event01_001.jpg"),
+		filepath.Join(event, "event01_004.jpg"),
+		filepath.Join(event, "event01_005.jpg"),
+		filepath.Join(event, "event01_006.jpg"),
+	)
+	tu.AssertNotExists(
+		filepath.Join(event, "event01_002.jpg"),
+		filepath.Join(event, "event01_003.jpg"),
+		filepath.Join(event, "partial.jpg"),
+		filepath.Join(event, "started.jpg"),
+		filepath.Join(event, PROGRESSFILE),
+	)
+	for _, name := range []string{"event01_005.jpg", "event01_006.jpg"} {
+		if info := tu.AssertExists(filepath.Join(event, name))[0]; info != nil && info.Size() == 0 {
+			tu.Fail("Placeholder left behind", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(event, context.SOURCEDIR, "partial.jpg")); err != nil {
+		tu.Fail(err)
+	}
+}
+
+func TestRenameCompressFail(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Compress command needs a shell")
+	}
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	event := filepath.Join(tu.Dir, "event01")
+	cxt := tu.MustFatal(context.NewContext(event)).(*context.Context)
+
+	// Compress leaves its output behind, then fails
+	if _, err := Rename(cxt, true); err == nil {
+		tu.FailNow("Allowed failing compress command")
+	}
+	tu.AssertExists(filepath.Join(event, "a.txt"))
+	tu.AssertNotExists(
+		filepath.Join(event, "tmp-a.txt"),
+		filepath.Join(event, "event01_001.txt"),
+	)
+
+	// Rename again recovers, and fails the same way. Leaving nothing behind to block a lock
+	if _, err := Rename(cxt, true); err == nil || os.IsExist(err) {
+		tu.Fail("Expected compress command to fail again. Got", err)
+	}
+	tu.Must(Rename(cxt, false))
+	tu.AssertExists(filepath.Join(event, "event01_001.txt"))
+	tu.AssertNotExists(filepath.Join(event, "tmp-a.txt"), filepath.Join(event, PROGRESSFILE))
+	tu.Must(lock.LockEvent(cxt, event, false))
+}
+
+func TestRenameCompressFailMany(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Compress command needs a shell")
+	}
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	event := filepath.Join(tu.Dir, "event01")
+	cxt := tu.MustFatal(context.NewContext(event)).(*context.Context)
+
+	// Several files fail to compress. The first failure is kept, and progress left behind
+	renamed, err := Rename(cxt, true)
+	if err == nil {
+		tu.FailNow("Allowed failing compress commands")
+	}
+	tu.AssertExists(filepath.Join(event, "a.txt"), filepath.Join(event, "c.txt"), filepath.Join(event, PROGRESSFILE))
+
+	// Rename again recovers, and finishes the job. Files renamed the first time keep their names
+	for source, dest := range tu.Must(Rename(cxt, false)).(map[string]string) {
+		renamed[source] = dest
+	}
+	if len(renamed) != 4 {
+		tu.Fail("Expected every file to be renamed. Got", renamed)
+	}
+	for _, dest := range renamed {
+		tu.AssertExists(dest)
+	}
+	tu.AssertNotExists(filepath.Join(event, "a.txt"), filepath.Join(event, "c.txt"), filepath.Join(event, PROGRESSFILE))
+}
+
+func TestRecoverLeftovers(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	event := filepath.Join(tu.Dir, "event01")
+	cxt := tu.MustFatal(context.NewContext(event)).(*context.Context)
+
+	// No progress file. Leftovers are still found
+	tu.Must(Recover(cxt))
+	tu.AssertNotExists(
+		filepath.Join(event, "tmp-a.txt"),
+		filepath.Join(event, "event01_002.txt"),
+	)
+	tu.AssertExists(
+		filepath.Join(event, "a.txt"),
+		filepath.Join(event, "event01_001.txt"),
+	)
+	tu.Must(lock.LockEvent(cxt, event, false))
+}
+
 func TestSetEnviron(t *testing.T) {
 	tu := testutil.NewTestUtil(t)
 
@@ -0,0 +1,246 @@
+package search
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	gosort "sort"
+	"strings"
+	"time"
+
+	"github.com/internetimagery/photos/context"
+	"github.com/internetimagery/photos/format"
+	"github.com/internetimagery/photos/sort"
+)
+
+// Query : Boolean query to run against the terms (tags, event and folder names) describing media
+type Query interface {
+	Match(terms map[string]struct{}) bool
+}
+
+// termQuery : Match a single term
+type termQuery string
+
+func (query termQuery) Match(terms map[string]struct{}) bool {
+	_, ok := terms[string(query)]
+	return ok
+}
+
+// notQuery : Invert match
+type notQuery struct {
+	Query
+}
+
+func (query notQuery) Match(terms map[string]struct{}) bool {
+	return !query.Query.Match(terms)
+}
+
+// andQuery : Match all queries
+type andQuery []Query
+
+func (query andQuery) Match(terms map[string]struct{}) bool {
+	for _, q := range query {
+		if !q.Match(terms) {
+			return false
+		}
+	}
+	return true
+}
+
+// orQuery : Match any query
+type orQuery []Query
+
+func (query orQuery) Match(terms map[string]struct{}) bool {
+	for _, q := range query {
+		if q.Match(terms) {
+			return true
+		}
+	}
+	return false
+}
+
+// parser : Walk through tokens building up a query
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+// peek : Look at current token without consuming it. Empty string at the end.
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// parseOr : or := and ("OR" and)*
+func (p *parser) parseOr() (Query, error) {
+	query := orQuery{}
+	for {
+		q, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		query = append(query, q)
+		if p.peek() != "OR" {
+			break
+		}
+		p.pos++
+	}
+	if len(query) == 1 {
+		return query[0], nil
+	}
+	return query, nil
+}
+
+// parseAnd : and := not (["AND"] not)*
+func (p *parser) parseAnd() (Query, error) {
+	query := andQuery{}
+	for {
+		q, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		query = append(query, q)
+		next := p.peek()
+		if next == "AND" {
+			p.pos++
+		} else if next == "" || next == "OR" || next == ")" {
+			break
+		}
+	}
+	if len(query) == 1 {
+		return query[0], nil
+	}
+	return query, nil
+}
+
+// parseNot : not := "NOT" not | "(" or ")" | term
+func (p *parser) parseNot() (Query, error) {
+	token := p.peek()
+	p.pos++
+	switch token {
+	case "":
+		return nil, fmt.Errorf("unexpected end of query")
+	case "NOT":
+		q, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notQuery{q}, nil
+	case "(":
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing closing bracket in query")
+		}
+		p.pos++
+		return q, nil
+	case ")", "AND", "OR":
+		return nil, fmt.Errorf("unexpected '%s' in query", token)
+	}
+	return termQuery(strings.ToLower(token)), nil
+}
+
+// ParseQuery : Build a query from text. ie "alice AND (beach OR pool) NOT 2017". Terms side by side are implicitly AND.
+func ParseQuery(text string) (Query, error) {
+	text = strings.NewReplacer("(", " ( ", ")", " ) ").Replace(text)
+	p := &parser{tokens: strings.Fields(text)}
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("empty query")
+	}
+	query, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected '%s' in query", p.peek())
+	}
+	return query, nil
+}
+
+// Result : Media matching a search
+type Result struct {
+	Path  string   `json:"path"`           // Full path to media
+	Event string   `json:"event"`          // Event name
+	Index int      `json:"index"`          // ID of media
+	Tags  []string `json:"tags"`           // Tags on the media
+	Date  string   `json:"date,omitempty"` // Date taken from event name, if it has one
+}
+
+// Results : Collection of search results
+type Results []*Result
+
+// Save : Write results out as JSON
+func (results Results) Save(handle io.Writer) error {
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = handle.Write(append(data, '\n'))
+	return err
+}
+
+// getTerms : Collect searchable terms from media. Tags, along with the words in its event and parent folder names.
+func getTerms(cxt *context.Context, media *format.Media) map[string]struct{} {
+	terms := map[string]struct{}{}
+	for tag := range media.Tags {
+		terms[strings.ToLower(tag)] = struct{}{}
+	}
+	relpath, err := filepath.Rel(cxt.Root, filepath.Dir(media.Path))
+	if err != nil {
+		return terms
+	}
+	for _, folder := range strings.Split(filepath.ToSlash(relpath), "/") {
+		folder = strings.ToLower(folder)
+		terms[folder] = struct{}{}
+		for _, word := range strings.FieldsFunc(folder, func(r rune) bool { return r == ' ' || r == '_' }) {
+			terms[word] = struct{}{}
+		}
+	}
+	return terms
+}
+
+// Search : Look through all formatted media in the project for those matching the query (nil matches all).
+// Optionally limit to events dated within the from / to range (zero times are ignored).
+func Search(cxt *context.Context, query Query, from, to time.Time) (Results, error) {
+	results := Results{}
+	err := cxt.WalkEvents(func(eventPath string) error {
+		var date time.Time
+		if !from.IsZero() || !to.IsZero() {
+			var ok bool
+			if date, ok = sort.ParseDate(filepath.Base(eventPath)); !ok {
+				return nil // No date. Cannot be within range.
+			}
+			if (!from.IsZero() && date.Before(from)) || (!to.IsZero() && date.After(to)) {
+				return nil
+			}
+		}
+		mediaList, err := format.GetMediaFromDirectory(eventPath)
+		if err != nil {
+			return err
+		}
+		for _, media := range mediaList {
+			if media.Index == 0 { // Only search formatted media
+				continue
+			}
+			if query != nil && !query.Match(getTerms(cxt, media)) {
+				continue
+			}
+			result := &Result{Path: media.Path, Event: media.Event, Index: media.Index, Tags: []string{}}
+			for tag := range media.Tags {
+				result.Tags = append(result.Tags, tag)
+			}
+			gosort.Strings(result.Tags)
+			if date, ok := sort.ParseDate(media.Event); ok {
+				result.Date = date.Format("2006-01-02")
+			}
+			results = append(results, result)
+		}
+		return nil
+	})
+	return results, err
+}
@@ -0,0 +1,100 @@
+package search
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/internetimagery/photos/context"
+	"github.com/internetimagery/photos/testutil"
+)
+
+func TestParseQuery(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+
+	terms := map[string]struct{}{"alice": struct{}{}, "beach": struct{}{}, "2018": struct{}{}}
+
+	testCase := map[string]bool{
+		"alice":                              true,
+		"ALICE":                              true,
+		"bob":                                false,
+		"alice beach":                        true,
+		"alice AND bob":                      false,
+		"alice OR bob":                       true,
+		"alice NOT 2018":                     false,
+		"alice AND NOT 2017":                 true,
+		"NOT (bob OR 2017)":                  true,
+		"(alice OR bob) AND (beach)":         true,
+		"bob OR alice AND NOT beach":         false,
+		"NOT NOT alice":                      true,
+		"alice AND (bob OR (beach OR pool))": true,
+	}
+	for text, expect := range testCase {
+		query, err := ParseQuery(text)
+		if err != nil {
+			tu.Fail(text, err)
+			continue
+		}
+		if query.Match(terms) != expect {
+			tu.Fail("Query did not match as expected:", text)
+		}
+	}
+
+	for _, text := range []string{"", "alice AND", "OR alice", "(alice", "alice)", "NOT"} {
+		if _, err := ParseQuery(text); err == nil {
+			tu.Fail("Allowed bad query:", text)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	cxt := tu.MustFatal(context.NewContext(tu.Dir)).(*context.Context)
+
+	search := func(text string, from, to time.Time) []string {
+		var query Query
+		if text != "" {
+			query = tu.MustFatal(ParseQuery(text)).(Query)
+		}
+		paths := []string{}
+		for _, result := range tu.MustFatal(Search(cxt, query, from, to)).(Results) {
+			paths = append(paths, tu.MustFatal(filepath.Rel(tu.Dir, result.Path)).(string))
+		}
+		return paths
+	}
+	compare := func(expect, got []string) {
+		if len(expect) != len(got) {
+			tu.FailE(expect, got)
+			return
+		}
+		for i := range expect {
+			if filepath.FromSlash(expect[i]) != got[i] {
+				tu.FailE(expect, got)
+				return
+			}
+		}
+	}
+
+	// Search by tag (case insensitive), ignoring sorted and unformatted media
+	compare([]string{
+		"2017/17-06-01 beach/17-06-01 beach_001[alice].jpg",
+		"2018/18-01-10 beach trip/18-01-10 beach trip_001[alice bob].jpg",
+		"2018/18-03-03 party/18-03-03 party_001[Alice].jpg",
+	}, search("alice", time.Time{}, time.Time{}))
+
+	// Search by tag and event / folder names
+	compare([]string{
+		"2018/18-01-10 beach trip/18-01-10 beach trip_001[alice bob].jpg",
+	}, search("alice AND beach NOT 2017", time.Time{}, time.Time{}))
+
+	// Search by date range
+	compare([]string{
+		"2018/18-01-10 beach trip/18-01-10 beach trip_001[alice bob].jpg",
+		"2018/18-01-10 beach trip/18-01-10 beach trip_002[bob].jpg",
+	}, search("", time.Date(2018, 1, 1, 0, 0, 0, 0, time.Local), time.Date(2018, 1, 10, 0, 0, 0, 0, time.Local)))
+	compare([]string{
+		"2018/18-03-03 party/18-03-03 party_001[Alice].jpg",
+	}, search("alice", time.Date(2018, 1, 11, 0, 0, 0, 0, time.Local), time.Time{}))
+}
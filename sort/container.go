@@ -0,0 +1,379 @@
+package sort
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"time"
+)
+
+// Reading capture dates (and cameras) from media that exif.Decode does not understand. Videos (QuickTime / MP4), HEIC / HEIF images and RAW images (TIFF based. ie CR2, NEF, DNG, ARW)
+
+// heifBrands : ftyp brands that mark a file as HEIF (rather than video)
+var heifBrands = map[string]struct{}{"heic": {}, "heix": {}, "heim": {}, "heis": {}, "hevc": {}, "hevx": {}, "mif1": {}, "msf1": {}, "avif": {}}
+
+// quicktimeAtoms : Atoms that can start a QuickTime file without an ftyp
+var quicktimeAtoms = map[string]struct{}{"moov": {}, "mdat": {}, "wide": {}, "free": {}, "skip": {}, "pnot": {}}
+
+// quicktimeEpoch : Time QuickTime timestamps count from
+var quicktimeEpoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// getContainerDate : Get the capture date from a video, HEIF or RAW file. Preferring the date the photo was taken.
+// Also reports if the date is a wall clock time, with no timezone of its own (ie EXIF). False if the format is not known, or has no date
+func getContainerDate(reader io.ReaderAt, size int64) (time.Time, bool, bool) {
+	header := make([]byte, 12)
+	if _, err := reader.ReadAt(header, 0); err != nil {
+		return time.Time{}, false, false
+	}
+	if _, ok := quicktimeAtoms[string(header[4:8])]; ok || (string(header[4:8]) == "ftyp" && !isHEIF(header)) {
+		return getQuickTimeDate(reader, size)
+	}
+	tags := getContainerTags(reader, size)
+	for _, tag := range []uint16{tiffDateTimeOriginal, tiffDateTimeDigitized, tiffDateTime} {
+		if taken, err := time.ParseInLocation("2006:01:02 15:04:05", tags[tag], time.Local); err == nil {
+			return taken, true, true
+		}
+	}
+	return time.Time{}, false, false
+}
+
+// getContainerCamera : Get the camera make and model from a HEIF or RAW file. Empty if not known
+func getContainerCamera(reader io.ReaderAt, size int64) (string, string) {
+	tags := getContainerTags(reader, size)
+	return tags[tiffMake], tags[tiffModel]
+}
+
+// isHEIF : Check file header for a HEIF brand
+func isHEIF(header []byte) bool {
+	_, ok := heifBrands[string(header[8:12])]
+	return string(header[4:8]) == "ftyp" && ok
+}
+
+// getContainerTags : Get the EXIF text tags from HEIF or RAW file
+func getContainerTags(reader io.ReaderAt, size int64) map[uint16]string {
+	header := make([]byte, 12)
+	if _, err := reader.ReadAt(header, 0); err != nil {
+		return map[uint16]string{}
+	}
+	if string(header[:4]) == "II*\x00" || string(header[:4]) == "MM\x00*" {
+		return getTIFFTags(reader, size)
+	}
+	if isHEIF(header) {
+		return getHEIFTags(reader, size)
+	}
+	return map[uint16]string{}
+}
+
+// box : ISO base media (QuickTime / MP4 / HEIF) box. Also known as an atom
+type box struct {
+	kind   string
+	offset int64 // Start of box contents
+	size   int64 // Size of box contents
+}
+
+// readBoxes : Read boxes laid side by side between start and end
+func readBoxes(reader io.ReaderAt, start, end int64) []box {
+	boxes := []box{}
+	header := make([]byte, 16)
+	for start+8 <= end {
+		if _, err := reader.ReadAt(header[:8], start); err != nil {
+			break
+		}
+		size, headerSize := int64(binary.BigEndian.Uint32(header[:4])), int64(8)
+		switch size {
+		case 0: // Box runs to the end
+			size = end - start
+		case 1: // Large box. Real size follows
+			if _, err := reader.ReadAt(header[8:16], start+8); err != nil {
+				return boxes
+			}
+			size, headerSize = int64(binary.BigEndian.Uint64(header[8:16])), 16
+		}
+		if size < headerSize || start+size > end {
+			break // Corrupt. Take what we have
+		}
+		boxes = append(boxes, box{kind: string(header[4:8]), offset: start + headerSize, size: size - headerSize})
+		start += size
+	}
+	return boxes
+}
+
+// findBox : Follow a path of box types (ie moov, udta) down from the given range
+func findBox(reader io.ReaderAt, start, end int64, path ...string) (box, bool) {
+	for i, kind := range path {
+		found := false
+		for _, child := range readBoxes(reader, start, end) {
+			if child.kind == kind {
+				if i == len(path)-1 {
+					return child, true
+				}
+				start, end, found = child.offset, child.offset+child.size, true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return box{}, false
+}
+
+// readBox : Read the contents of a box
+func readBox(reader io.ReaderAt, b box) ([]byte, bool) {
+	if b.size > 1<<24 { // Nothing we want is this large
+		return nil, false
+	}
+	data := make([]byte, b.size)
+	if _, err := reader.ReadAt(data, b.offset); err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// getQuickTimeDate : Get date from QuickTime / MP4 video. Preferring the ©day atom (which keeps the timezone) over the movie header (UTC).
+// Also reports if the date is a wall clock time (©day without a timezone)
+func getQuickTimeDate(reader io.ReaderAt, size int64) (time.Time, bool, bool) {
+	if day, ok := findBox(reader, 0, size, "moov", "udta", "\xa9day"); ok {
+		if data, ok := readBox(reader, day); ok && len(data) > 4 {
+			length := int(binary.BigEndian.Uint16(data[:2]))
+			if length > len(data)-4 {
+				length = len(data) - 4
+			}
+			if taken, wall, ok := parseISODate(string(data[4 : 4+length])); ok {
+				return taken, wall, true
+			}
+		}
+	}
+	if mvhd, ok := findBox(reader, 0, size, "moov", "mvhd"); ok {
+		if data, ok := readBox(reader, mvhd); ok && len(data) >= 12 {
+			var seconds uint64
+			if data[0] == 1 { // Version 1 uses 64 bit times
+				seconds = binary.BigEndian.Uint64(data[4:12])
+			} else {
+				seconds = uint64(binary.BigEndian.Uint32(data[4:8]))
+			}
+			if seconds != 0 { // Zero is used when date is not known
+				return quicktimeEpoch.Add(time.Duration(seconds) * time.Second).Local(), false, true
+			}
+		}
+	}
+	return time.Time{}, false, false
+}
+
+// parseISODate : Parse the date formats found in video metadata. Also reports if the date is a wall clock time, with no timezone given
+func parseISODate(text string) (time.Time, bool, bool) {
+	text = strings.TrimSpace(strings.Trim(text, "\x00"))
+	for _, layout := range []string{"2006-01-02T15:04:05Z07:00", "2006-01-02T15:04:05-0700"} {
+		if taken, err := time.ParseInLocation(layout, text, time.Local); err == nil {
+			return taken, false, true
+		}
+	}
+	if taken, err := time.ParseInLocation("2006-01-02T15:04:05", text, time.Local); err == nil {
+		return taken, true, true
+	}
+	return time.Time{}, false, false
+}
+
+// getHEIFTags : Get EXIF text tags from the EXIF block stored as an item within a HEIF image
+func getHEIFTags(reader io.ReaderAt, size int64) map[uint16]string {
+	tags := map[uint16]string{}
+	meta, ok := findBox(reader, 0, size, "meta")
+	if !ok || meta.size < 4 {
+		return tags
+	}
+	metaStart, metaEnd := meta.offset+4, meta.offset+meta.size // Skip version and flags
+
+	// Find the ID of the EXIF item
+	iinf, ok := findBox(reader, metaStart, metaEnd, "iinf")
+	if !ok || iinf.size < 6 {
+		return tags
+	}
+	version, _ := readBox(reader, box{offset: iinf.offset, size: 1})
+	entries := iinf.offset + 6
+	if len(version) == 1 && version[0] != 0 {
+		entries += 2 // Count is 32 bit
+	}
+	exifID, found := uint32(0), false
+	for _, infe := range readBoxes(reader, entries, iinf.offset+iinf.size) {
+		data, ok := readBox(reader, infe)
+		if !ok || infe.kind != "infe" || len(data) < 4 || data[0] < 2 {
+			continue
+		}
+		if data[0] == 2 && len(data) >= 12 && string(data[8:12]) == "Exif" {
+			exifID, found = uint32(binary.BigEndian.Uint16(data[4:6])), true
+		} else if data[0] >= 3 && len(data) >= 14 && string(data[10:14]) == "Exif" {
+			exifID, found = binary.BigEndian.Uint32(data[4:8]), true
+		}
+		if found {
+			break
+		}
+	}
+	if !found {
+		return tags
+	}
+
+	// Find where the item lives
+	iloc, ok := findBox(reader, metaStart, metaEnd, "iloc")
+	if !ok {
+		return tags
+	}
+	data, ok := readBox(reader, iloc)
+	if !ok {
+		return tags
+	}
+	offset, length, ok := parseItemLocation(data, exifID)
+	if !ok || length < 4 || length > 1<<24 || offset+length > uint64(size) {
+		return tags
+	}
+	exifData := make([]byte, length)
+	if _, err := reader.ReadAt(exifData, int64(offset)); err != nil {
+		return tags
+	}
+
+	// EXIF item starts with the offset to the TIFF header (past "Exif\0\0")
+	skip := uint64(binary.BigEndian.Uint32(exifData[:4])) + 4
+	if skip >= length {
+		return tags
+	}
+	tiff := exifData[skip:]
+	return getTIFFTags(bytes.NewReader(tiff), int64(len(tiff)))
+}
+
+// parseItemLocation : Find the file offset and length of an item from HEIF iloc box contents
+func parseItemLocation(data []byte, itemID uint32) (uint64, uint64, bool) {
+	pos := 0
+	readInt := func(size int) (uint64, bool) {
+		if pos+size > len(data) {
+			return 0, false
+		}
+		value := uint64(0)
+		for _, b := range data[pos : pos+size] {
+			value = value<<8 | uint64(b)
+		}
+		pos += size
+		return value, true
+	}
+	if len(data) < 6 {
+		return 0, 0, false
+	}
+	version := data[0]
+	offsetSize, lengthSize := int(data[4]>>4), int(data[4]&0xf)
+	baseOffsetSize, indexSize := int(data[5]>>4), 0
+	if version == 1 || version == 2 {
+		indexSize = int(data[5] & 0xf)
+	}
+	pos = 6
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+	count, ok := readInt(idSize)
+	for i := uint64(0); ok && i < count; i++ {
+		var id, method, base, extents uint64
+		if id, ok = readInt(idSize); !ok {
+			break
+		}
+		if version == 1 || version == 2 {
+			if method, ok = readInt(2); !ok {
+				break
+			}
+			method &= 0xf
+		}
+		if _, ok = readInt(2); !ok { // Data reference index
+			break
+		}
+		if base, ok = readInt(baseOffsetSize); !ok {
+			break
+		}
+		if extents, ok = readInt(2); !ok {
+			break
+		}
+		for j := uint64(0); j < extents; j++ {
+			var offset, length uint64
+			if _, ok = readInt(indexSize); !ok {
+				break
+			}
+			if offset, ok = readInt(offsetSize); !ok {
+				break
+			}
+			if length, ok = readInt(lengthSize); !ok {
+				break
+			}
+			if id == uint64(itemID) && j == 0 && method == 0 && extents == 1 { // Only handling simple items stored directly in the file
+				return base + offset, length, true
+			}
+		}
+		if id == uint64(itemID) {
+			break
+		}
+	}
+	return 0, 0, false
+}
+
+// TIFF tags of interest
+const (
+	tiffMake              = 0x010f
+	tiffModel             = 0x0110
+	tiffDateTime          = 0x0132
+	tiffExifIFD           = 0x8769
+	tiffDateTimeOriginal  = 0x9003
+	tiffDateTimeDigitized = 0x9004
+)
+
+// getTIFFTags : Get text tags of interest from TIFF structured data (RAW images, and the EXIF block in HEIF)
+func getTIFFTags(reader io.ReaderAt, size int64) map[uint16]string {
+	tags := map[uint16]string{}
+	header := make([]byte, 8)
+	if _, err := reader.ReadAt(header, 0); err != nil {
+		return tags
+	}
+	var order binary.ByteOrder
+	switch string(header[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return tags
+	}
+
+	readIFD := func(offset int64) (exifOffset int64) {
+		count := make([]byte, 2)
+		if offset <= 0 || offset+2 > size {
+			return 0
+		}
+		if _, err := reader.ReadAt(count, offset); err != nil {
+			return 0
+		}
+		entry := make([]byte, 12)
+		for i := int64(0); i < int64(order.Uint16(count)); i++ {
+			if _, err := reader.ReadAt(entry, offset+2+i*12); err != nil {
+				break
+			}
+			tag, length := order.Uint16(entry[:2]), int64(order.Uint32(entry[4:8]))
+			switch tag {
+			case tiffExifIFD:
+				exifOffset = int64(order.Uint32(entry[8:12]))
+			case tiffMake, tiffModel, tiffDateTime, tiffDateTimeOriginal, tiffDateTimeDigitized:
+				value := entry[8:12]
+				if length > 4 && length < 64 {
+					value = make([]byte, length)
+					if _, err := reader.ReadAt(value, int64(order.Uint32(entry[8:12]))); err != nil {
+						continue
+					}
+				} else if length <= 4 {
+					value = value[:length]
+				} else {
+					continue
+				}
+				tags[tag] = strings.TrimSpace(strings.Trim(string(value), "\x00"))
+			}
+		}
+		return exifOffset
+	}
+	if exifOffset := readIFD(int64(order.Uint32(header[4:8]))); exifOffset != 0 {
+		readIFD(exifOffset)
+	}
+	return tags
+}
@@ -0,0 +1,64 @@
+package sort
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/internetimagery/photos/context"
+	"github.com/internetimagery/photos/format"
+)
+
+// collectDirectory : Gather media from a directory (and optionally its sub-directories) using the include / exclude patterns in config.
+// Media that belongs together within a directory (ie RAW+JPEG pairs and their sidecars, see format.GroupMedia) is kept together. Returns each group of media, in order.
+func collectDirectory(cxt *context.Context, dirPath string, options *Options) ([][]string, error) {
+	dirs := []string{dirPath}
+	if options.Recursive {
+		dirs = []string{}
+		if err := filepath.Walk(dirPath, func(filename string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			if filename != dirPath && (info.Name()[0] == '.' || cxt.Config.SortExclude.Match(filename)) {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, filename)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	groups := [][]string{}
+	for _, dir := range dirs {
+		mediaItems, err := format.GetMediaFromDirectory(dir)
+		if err != nil {
+			return nil, err
+		}
+		wanted := []*format.Media{}
+		for _, item := range mediaItems {
+			switch {
+			case cxt.Config.SortExclude.Match(item.Path):
+			case cxt.Config.Sidecars.Match(item.Path):
+				if options.SkipSidecars {
+					log.Println("Skipping sidecar:", item.Path)
+					continue
+				}
+				wanted = append(wanted, item)
+			case len(cxt.Config.SortInclude) == 0 || cxt.Config.SortInclude.Match(item.Path):
+				wanted = append(wanted, item)
+			}
+		}
+		for _, group := range format.GroupMedia(wanted) {
+			paths := []string{}
+			for _, media := range group {
+				paths = append(paths, media.Path)
+			}
+			groups = append(groups, paths)
+		}
+	}
+	return groups, nil
+}
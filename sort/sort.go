@@ -5,44 +5,150 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	gosort "sort"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/internetimagery/photos/context"
-	"github.com/internetimagery/photos/format"
-	"github.com/internetimagery/photos/copy"
+	"github.com/internetimagery/photos/lock"
+	"github.com/internetimagery/photos/progress"
 	"github.com/rwcarlsen/goexif/exif"
 )
 
 // GetMediaDate : Get modification date, or date taken (EXIF data) from file
 func GetMediaDate(filePath string) (time.Time, error) {
+	taken, _, err := getMediaDate(filePath)
+	return taken, err
+}
+
+// getMediaDate : Get modification date, or date taken from file (see GetMediaDate).
+// Also reports if the date is a wall clock time, with no timezone of its own (ie EXIF). These are read as local time
+func getMediaDate(filePath string) (time.Time, bool, error) {
 
 	// Get a handle on things... get it!
 	handle, err := os.Open(filePath)
 	if err != nil {
-		return time.Time{}, err
+		return time.Time{}, false, err
 	}
 	defer handle.Close()
 	info, err := handle.Stat()
 	if err != nil {
-		return time.Time{}, err
+		return time.Time{}, false, err
 	}
 
 	// Only process regular files
 	if !info.Mode().IsRegular() {
-		return time.Time{}, fmt.Errorf("can only get media date from files")
+		return time.Time{}, false, fmt.Errorf("can only get media date from files")
 	}
 
 	// Try processing exif data
 	if exifData, err := exif.Decode(handle); err == nil {
 		taken, err := exifData.DateTime()
 		if err == nil {
-			return taken, nil
+			return taken, true, nil
 		}
-		return time.Time{}, err
+		return time.Time{}, false, err
+	}
+	// Not an image exif understands. Try videos, HEIC and RAW images
+	if taken, wall, ok := getContainerDate(handle, info.Size()); ok {
+		return taken, wall, nil
 	}
 	// We failed to decode it? Ah well... fall back to using modtime
-	return info.ModTime(), nil
+	return info.ModTime(), false, nil
+}
+
+// GetMediaCamera : Get make and model of camera that took the media (EXIF data). Empty if not known
+func GetMediaCamera(filePath string) (string, string, error) {
+	handle, err := os.Open(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	defer handle.Close()
+	exifData, err := exif.Decode(handle)
+	if err != nil { // Not an image exif understands. Try HEIC and RAW images
+		info, err := handle.Stat()
+		if err != nil {
+			return "", "", err
+		}
+		cameraMake, cameraModel := getContainerCamera(handle, info.Size())
+		return cameraMake, cameraModel, nil
+	}
+	info := []string{}
+	for _, field := range []exif.FieldName{exif.Make, exif.Model} {
+		value := ""
+		if tag, err := exifData.Get(field); err == nil {
+			if value, err = tag.StringVal(); err != nil {
+				value = ""
+			}
+		}
+		info = append(info, strings.TrimSpace(strings.Trim(value, "\x00")))
+	}
+	return info[0], info[1], nil
+}
+
+// Folder : Information about media, available to the sort_layout template when choosing a folder to sort into
+type Folder struct {
+	Year        string // ie 2018
+	YY          string // ie 18
+	Month       string // ie October
+	MM          string // ie 10
+	DD          string // ie 22
+	Weekday     string // ie Monday
+	CameraMake  string // ie Canon. "Unknown" if not known
+	CameraModel string // ie Canon EOS 5D. "Unknown" if not known
+}
+
+// ParseLayout : Prepare sort_layout template for use with FormatFolder
+func ParseLayout(layout string) (*template.Template, error) {
+	return template.New("sort_layout").Option("missingkey=error").Parse(layout)
+}
+
+// cleanFolderName : Make text safe to use as (part of) a folder name
+func cleanFolderName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < ' ' {
+			return '-'
+		}
+		return r
+	}, name)
+	if name = strings.TrimSpace(name); name == "" {
+		return "Unknown"
+	}
+	return name
+}
+
+// FormatFolder : Build folder path (relative to the sorted folder) for media using the sort_layout template
+func FormatFolder(layout *template.Template, date time.Time, cameraMake, cameraModel string) (string, error) {
+	data := &Folder{
+		Year:        date.Format("2006"),
+		YY:          date.Format("06"),
+		Month:       date.Format("January"),
+		MM:          date.Format("01"),
+		DD:          date.Format("02"),
+		Weekday:     date.Format("Monday"),
+		CameraMake:  cleanFolderName(cameraMake),
+		CameraModel: cleanFolderName(cameraModel),
+	}
+	buf := new(strings.Builder)
+	if err := layout.Execute(buf, data); err != nil {
+		return "", err
+	}
+	parts := []string{}
+	for _, part := range strings.Split(buf.String(), "/") { // Template uses / to make subfolders
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if part == "." || part == ".." {
+			return "", fmt.Errorf("sort_layout cannot move outside the sorted folder '%s'", buf.String())
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("sort_layout produced an empty folder name")
+	}
+	return filepath.Join(parts...), nil
 }
 
 // FormatDate : Format date into simple YY-MM-DD style
@@ -50,6 +156,19 @@ func FormatDate(date time.Time) string {
 	return date.Format("06-01-02")
 }
 
+// ParseDate : Counterpart to FormatDate. Pull the date from the start of a name (ie an event) if it has one
+func ParseDate(name string) (time.Time, bool) {
+	layout := "06-01-02"
+	if len(name) < len(layout) {
+		return time.Time{}, false
+	}
+	date, err := time.ParseInLocation(layout, name[:len(layout)], time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return date, true
+}
+
 // UniqueName : Ensure name is a unique filename so as to not override existing
 func UniqueName(filename string) string {
 	if _, err := os.Stat(filename); os.IsNotExist(err) {
@@ -68,69 +187,288 @@ func UniqueName(filename string) string {
 	return filename
 }
 
-// SortMedia : Grab dates assosicated with media in working directory, and place them in corresponding folders
-func SortMedia(cxt *context.Context, copyFiles bool, source ...string) error {
+// uniqueNames : Same as UniqueName, for media that belongs together (see format.GroupMedia) so it keeps sharing a name.
+// ie IMG_01.CR2, IMG_01.JPG and IMG_01.JPG.xmp become IMG_01_1.CR2, IMG_01_1.JPG and IMG_01_1.JPG.xmp if any of those names are taken
+func uniqueNames(folder string, names []string) []string {
+	stem := names[0][:len(names[0])-len(filepath.Ext(names[0]))] // Name shared by the group
+	splits := make([]int, len(names))                            // Where each name is made unique
+	for i, name := range names {
+		if len(name) > len(stem) && strings.EqualFold(name[:len(stem)], stem) {
+			splits[i] = len(stem)
+		} else {
+			splits[i] = len(name) - len(filepath.Ext(name))
+		}
+	}
+	for index := 0; ; index++ {
+		paths, taken := make([]string, len(names)), false
+		for i, name := range names {
+			if index > 0 {
+				name = fmt.Sprintf("%s_%d%s", name[:splits[i]], index, name[splits[i]:])
+			}
+			paths[i] = filepath.Join(folder, name)
+			if _, err := os.Stat(paths[i]); !os.IsNotExist(err) {
+				taken = true
+			}
+		}
+		if !taken {
+			return paths
+		}
+	}
+}
+
+// Options : Options changing how media is sorted
+type Options struct {
+	Copy     bool           // Copy media instead of moving it
+	Verify   bool           // Check copied media matches its source, by comparing content hashes
+	Offset   time.Duration  // Correction added to the date of all media (along with any camera offsets in config)
+	Location *time.Location // Timezone to sort media into. Defaults to local time. Dates without a timezone (ie EXIF) are taken as being in this timezone
+
+	AllowDuplicates bool // Sort media even if its content already exists in the project. Duplicates are skipped otherwise
+	Recursive       bool // Search directories for media recursively
+	SkipSidecars    bool // Leave sidecar files behind, rather than bringing them along with their media
+}
+
+// Result : What happened to media while sorting
+type Result struct {
+	Sorted     map[string]string `json:"sorted"`     // Source mapped to where it was moved (or copied) to. Includes sidecars
+	Duplicates map[string]string `json:"duplicates"` // Source mapped to the media it duplicates, when left behind
+}
+
+// placeFile : Move (or copy) file into sorted folder
+func placeFile(cxt *context.Context, options *Options, sourcePath, destPath string) error {
+	if options.Copy {
+		log.Println("Copying:", sourcePath, "--->", destPath)
+		if options.Verify {
+			return cxt.Journal.CopyVerify(sourcePath, destPath, lock.ContentHash)
+		}
+		return cxt.Journal.Copy(sourcePath, destPath)
+	}
+	log.Println("Moving:", sourcePath, "--->", destPath)
+	return cxt.Journal.Move(sourcePath, destPath)
+}
+
+// collectHashes : Gather content hashes of media already in the project. Locked events use their lockfile.
+// Media in the sorted folder is hashed directly, though only if its size matches some incoming media.
+func collectHashes(cxt *context.Context, sizes map[int64]struct{}) (map[string]string, error) {
+	hashes := map[string]string{}
+	err := cxt.WalkEvents(func(eventPath string) error {
+		lockmap, err := lock.ReadLockFile(eventPath)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for basename, sshot := range lockmap {
+			if chash := sshot.ContentHash["SHA256"]; chash != "" {
+				hashes[chash] = filepath.Join(eventPath, basename)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.Walk(cxt.SortDir, func(filename string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) { // Nothing sorted yet
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if _, ok := sizes[info.Size()]; !ok {
+			return nil
+		}
+		chash, err := lock.HashFile(filename)
+		if err != nil {
+			return err
+		}
+		hashes[chash] = filename
+		return nil
+	})
+	return hashes, err
+}
+
+// SortMedia : Grab dates assosicated with media in working directory, and place them in corresponding folders. Options can be nil for defaults
+func SortMedia(cxt *context.Context, options *Options, source ...string) (*Result, error) {
+	if options == nil {
+		options = new(Options)
+	}
+	result := &Result{Sorted: map[string]string{}, Duplicates: map[string]string{}}
 
 	// Validate our inputs
 	if len(source) == 0 {
-		return fmt.Errorf("no sources provided to sort")
+		return nil, fmt.Errorf("no sources provided to sort")
+	}
+	groups := [][]string{} // Media that belongs together (ie RAW+JPEG pairs and sidecars) is sorted as one
+	seen := map[string]struct{}{}
+	addGroup := func(group []string) {
+		paths := []string{}
+		for _, path := range group {
+			if _, ok := seen[path]; !ok {
+				seen[path] = struct{}{}
+				paths = append(paths, path)
+			}
+		}
+		if len(paths) > 0 {
+			groups = append(groups, paths)
+		}
 	}
-	mediaPaths := map[string]struct{}{}
 	for _, src := range source { // Make paths absolute
 		cleansrc := cxt.AbsPath(src)
 		if strings.HasPrefix(cleansrc, cxt.Root) {
-			return fmt.Errorf("sorting source directory cannot be from within project")
+			return nil, fmt.Errorf("sorting source directory cannot be from within project")
 		}
 		info, err := os.Stat(cleansrc)
 		if err != nil {
-			return err
+			return result, err
 		}
 		if info.Mode().IsRegular() { // Add single files
-			mediaPaths[cleansrc] = struct{}{}
+			addGroup([]string{cleansrc})
 		} else if info.IsDir() {
-			mediaItems, err := format.GetMediaFromDirectory(cleansrc)
+			found, err := collectDirectory(cxt, cleansrc, options)
 			if err != nil {
-				return err
+				return result, err
 			}
-			for _, media := range mediaItems { // Add files from directory
-				mediaPaths[media.Path] = struct{}{}
+			for _, group := range found { // Add files from directory
+				addGroup(group)
 			}
 		}
 	}
 
-	if len(mediaPaths) == 0 {
-		return nil // Nothing to do...
+	if len(groups) == 0 {
+		return result, nil // Nothing to do...
 	}
 
 	// Ensure sorted dir exists
 	sortedDir := filepath.Join(cxt.Root, filepath.FromSlash(cxt.Config.Sorted))
-	if err := os.Mkdir(sortedDir, 0755); err != nil && !os.IsExist(err) {
-		return err
+	if err := cxt.Journal.Mkdir(sortedDir, 0755); err != nil && !os.IsExist(err) {
+		return result, err
 	}
 
-	// Move files into their folders
-	for sourcePath := range mediaPaths {
-		date, err := GetMediaDate(sourcePath)
+	// Prep our folder structure
+	layout, err := ParseLayout(cxt.Config.SortLayout)
+	if err != nil {
+		return result, err
+	}
+
+	// Gather what we already have, to check for duplicates. Sorting in order, so the first of any duplicates is kept
+	sizes, fileSizes := map[int64]struct{}{}, map[string]int64{}
+	totalFiles, totalSize := 0, int64(0)
+	for _, group := range groups {
+		for _, sourcePath := range group {
+			info, err := os.Stat(sourcePath)
+			if err != nil {
+				return result, err
+			}
+			sizes[info.Size()] = struct{}{}
+			fileSizes[sourcePath] = info.Size()
+			totalFiles++
+			totalSize += info.Size()
+		}
+	}
+	gosort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+	hashes, err := collectHashes(cxt, sizes)
+	if err != nil {
+		return result, err
+	}
+
+	// Move files into their folders. Each group goes into the folder of its first media (sidecars have no date of their own), sharing a unique name
+	skipped := 0
+	report := progress.NewReporter("sort")
+	defer report.Close()
+	report.Expect(totalFiles, totalSize)
+	for _, group := range groups {
+		isSidecar := func(string) bool { return false } // Sidecars on their own are sorted as media
+		for _, sourcePath := range group {
+			if !cxt.Config.Sidecars.Match(sourcePath) {
+				isSidecar = cxt.Config.Sidecars.Match
+				break
+			}
+		}
+		media, sidecars, chashes := []string{}, []string{}, map[string]string{}
+		for _, sourcePath := range group {
+			if isSidecar(sourcePath) {
+				sidecars = append(sidecars, sourcePath)
+				continue
+			}
+			report.Status("Sorting", sourcePath)
+			chash, err := lock.HashFile(sourcePath)
+			if err != nil {
+				return result, err
+			}
+			if existing, ok := hashes[chash]; ok {
+				if !options.AllowDuplicates {
+					log.Println("Skipping duplicate:", sourcePath, "===", existing)
+					result.Duplicates[sourcePath] = existing
+					skipped++
+					report.Done(sourcePath, fileSizes[sourcePath])
+					continue
+				}
+				log.Println("Duplicate:", sourcePath, "===", existing)
+			}
+			media = append(media, sourcePath)
+			chashes[sourcePath] = chash
+		}
+		if len(media) == 0 { // Nothing left to sort. Sidecars stay with their media
+			for _, sidecar := range sidecars {
+				report.Done(sidecar, fileSizes[sidecar])
+			}
+			continue
+		}
+
+		date, wall, err := getMediaDate(media[0])
 		if err != nil {
-			return err
+			return result, err
 		}
-		folderPath := filepath.Join(sortedDir, FormatDate(date))
-		if err = os.Mkdir(folderPath, 0755); err != nil && !os.IsExist(err) {
-			return err
+		cameraMake, cameraModel, err := GetMediaCamera(media[0])
+		if err != nil {
+			return result, err
 		}
-		destPath := UniqueName(filepath.Join(folderPath, filepath.Base(sourcePath)))
-		if copyFiles {
-			log.Println("Copying:", sourcePath, "--->", destPath)
-			if err = <-copy.File(sourcePath, destPath); err != nil {
-				return err
+		date = date.Add(options.Offset + cxt.Config.CameraOffsets.GetOffset(cameraMake, cameraModel)) // Correct camera clocks
+		if options.Location != nil {
+			if wall { // Camera clock was (hopefully) set to the time where it was taken. Keep the time, move it into the timezone
+				date = time.Date(date.Year(), date.Month(), date.Day(), date.Hour(), date.Minute(), date.Second(), date.Nanosecond(), options.Location)
+			} else {
+				date = date.In(options.Location)
 			}
-		} else {
-			log.Println("Moving:", sourcePath, "--->", destPath)
-			if err = os.Rename(sourcePath, destPath); err != nil {
-				return err
+		}
+		folder, err := FormatFolder(layout, date, cameraMake, cameraModel)
+		if err != nil {
+			return result, err
+		}
+		folderPath := sortedDir
+		for _, part := range strings.Split(folder, string(filepath.Separator)) { // Make each folder in turn, so they can be undone
+			folderPath = filepath.Join(folderPath, part)
+			if err = cxt.Journal.Mkdir(folderPath, 0755); err != nil && !os.IsExist(err) {
+				return result, err
 			}
 		}
+
+		// Keep the group in its original order, so it shares a name
+		sourcePaths, names := []string{}, []string{}
+		for _, sourcePath := range group {
+			if _, ok := chashes[sourcePath]; ok || isSidecar(sourcePath) {
+				sourcePaths = append(sourcePaths, sourcePath)
+				names = append(names, filepath.Base(sourcePath))
+			}
+		}
+		for i, destPath := range uniqueNames(folderPath, names) {
+			sourcePath := sourcePaths[i]
+			if err = placeFile(cxt, options, sourcePath, destPath); err != nil {
+				return result, err
+			}
+			result.Sorted[sourcePath] = destPath
+			if chash, ok := chashes[sourcePath]; ok {
+				hashes[chash] = destPath
+			}
+			report.Done(sourcePath, fileSizes[sourcePath])
+		}
 	}
 
-	return nil
+	if skipped > 0 {
+		log.Printf("Skipped %d duplicate(s) already in the project\n", skipped)
+	}
+	return result, nil
 }
@@ -4,9 +4,12 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"text/template"
 	"time"
 
+	"github.com/internetimagery/photos/config"
 	"github.com/internetimagery/photos/context"
+	"github.com/internetimagery/photos/lock"
 	"github.com/internetimagery/photos/testutil"
 )
 
@@ -21,6 +24,50 @@ func TestFormatDate(t *testing.T) {
 	}
 }
 
+func TestParseDate(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+
+	expectDate := time.Date(2008, 10, 16, 0, 0, 0, 0, time.Local)
+	if date, ok := ParseDate("08-10-16 some event"); !ok || !date.Equal(expectDate) {
+		tu.FailE(expectDate, date)
+	}
+	if date, ok := ParseDate(FormatDate(expectDate)); !ok || !date.Equal(expectDate) {
+		tu.FailE(expectDate, date)
+	}
+	if _, ok := ParseDate("some event"); ok {
+		tu.Fail("Parsed date from name without one")
+	}
+	if _, ok := ParseDate("08-10"); ok {
+		tu.Fail("Parsed date from short name")
+	}
+}
+
+func TestFormatFolder(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	date := time.Date(2018, 10, 22, 12, 0, 0, 0, time.Local)
+
+	tests := map[string]string{
+		"{{.YY}}-{{.MM}}-{{.DD}}":                  "18-10-22",
+		"{{.Year}}/{{.Month}}/{{.CameraModel}}":    filepath.Join("2018", "October", "EOS 5D-II"),
+		"{{.Year}}//{{.Weekday}} {{.CameraMake}}/": filepath.Join("2018", "Monday Unknown"),
+		"{{.Year}}/{{.YY}}-{{.MM}}-{{.DD}}":        filepath.Join("2018", "18-10-22"),
+	}
+	for test, expect := range tests {
+		layout := tu.MustFatal(ParseLayout(test)).(*template.Template)
+		if folder := tu.Must(FormatFolder(layout, date, "", " EOS 5D/II ")).(string); folder != expect {
+			tu.FailE(expect, folder)
+		}
+	}
+
+	// Test bad layouts
+	for _, test := range []string{"{{.Year}}/../{{.YY}}", " / ", "{{.Missing}}"} {
+		layout := tu.MustFatal(ParseLayout(test)).(*template.Template)
+		if _, err := FormatFolder(layout, date, "", ""); err == nil {
+			tu.Fail("Allowed bad layout", test)
+		}
+	}
+}
+
 func TestGetMediaDate(t *testing.T) {
 	tu := testutil.NewTestUtil(t)
 	defer tu.LoadTestdata()()
@@ -72,6 +119,28 @@ func TestGetMediaDateEXIF(t *testing.T) {
 
 }
 
+func TestGetMediaDateContainers(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	tests := map[string]string{
+		"video.mov":  "18-03-17", // ©day atom, taking priority over movie header
+		"video.mp4":  "18-10-22", // Movie header
+		"image.heic": "17-05-04", // EXIF item
+		"image.dng":  "15-06-07", // TIFF structure, taking original date
+		"notes.txt":  "00-10-10", // Unknown. Fall back to modtime
+	}
+	for name, expect := range tests {
+		testFile := filepath.Join(tu.Dir, name)
+		modtime := time.Date(2000, 10, 10, 10, 10, 10, 10, time.Local)
+		tu.MustFatal(os.Chtimes(testFile, modtime, modtime)) // Make sure modtime differs from metadata
+
+		if taken := tu.Must(GetMediaDate(testFile)).(time.Time); taken.Format("06-01-02") != expect {
+			tu.Fail("Bad date for", name, "Expected:", expect, "Got:", taken)
+		}
+	}
+}
+
 func TestUniqueName(t *testing.T) {
 	tu := testutil.NewTestUtil(t)
 	defer tu.LoadTestdata()()
@@ -114,7 +183,7 @@ func TestSortMedia(t *testing.T) {
 	)
 
 	// Run our sort on directory
-	tu.Must(SortMedia(cxt, false, tu.Dir))
+	tu.Must(SortMedia(cxt, nil, tu.Dir))
 
 	tu.AssertExists(
 		filepath.Join(dateDir, "file1.txt"),
@@ -127,7 +196,7 @@ func TestSortMedia(t *testing.T) {
 	)
 
 	// Run our sort on individual file
-	tu.Must(SortMedia(cxt, false, filepath.Join(tu.Dir, "outside", "file3.txt")))
+	tu.Must(SortMedia(cxt, nil, filepath.Join(tu.Dir, "outside", "file3.txt")))
 	tu.AssertExists(filepath.Join(dateDir, "file3.txt"))
 	tu.AssertNotExists(filepath.Join(tu.Dir, "outside", "file3.txt"))
 }
@@ -149,7 +218,7 @@ func TestSortMediaCopy(t *testing.T) {
 	)
 
 	// Run our sort on directory
-	tu.Must(SortMedia(cxt, true, tu.Dir))
+	tu.Must(SortMedia(cxt, &Options{Copy: true}, tu.Dir))
 
 	tu.AssertExists(
 		filepath.Join(dateDir, "file1.txt"),
@@ -162,7 +231,7 @@ func TestSortMediaCopy(t *testing.T) {
 	)
 
 	// Run our sort on individual file
-	tu.Must(SortMedia(cxt, true, filepath.Join(tu.Dir, "outside", "file3.txt")))
+	tu.Must(SortMedia(cxt, &Options{Copy: true}, filepath.Join(tu.Dir, "outside", "file3.txt")))
 	tu.AssertExists(filepath.Join(dateDir, "file3.txt"))
 	tu.AssertExists(filepath.Join(tu.Dir, "outside", "file3.txt"))
 }
@@ -176,7 +245,7 @@ func TestSortMediaInsideProject(t *testing.T) {
 	cxt := tu.MustFatal(context.NewContext(project)).(*context.Context)
 
 	// Run our sort
-	if err := SortMedia(cxt, false, filepath.Join(project, "event01")); err == nil {
+	if _, err := SortMedia(cxt, nil, filepath.Join(project, "event01")); err == nil {
 		tu.Fail("Allowed sorting media inside project")
 	}
 }
@@ -190,7 +259,262 @@ func TestSortMediaMissing(t *testing.T) {
 	cxt := tu.MustFatal(context.NewContext(project)).(*context.Context)
 
 	// Run our sort
-	if err := SortMedia(cxt, false, filepath.Join(tu.Dir, "somewhere")); err == nil {
+	if _, err := SortMedia(cxt, nil, filepath.Join(tu.Dir, "somewhere")); err == nil {
 		tu.Fail("Allowed missing source")
 	}
 }
+
+func TestSortMediaLayout(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	project := filepath.Join(tu.Dir, "project")
+	cxt := tu.MustFatal(context.NewContext(project)).(*context.Context)
+	tu.ModTime(2018, 10, 22, filepath.Join(tu.Dir, "file1.txt"))
+
+	// Test media lands in nested folders from config template
+	tu.Must(SortMedia(cxt, nil, filepath.Join(tu.Dir, "file1.txt")))
+	tu.AssertExists(filepath.Join(project, "Sorted", "2018", "18-10-22 Unknown", "file1.txt"))
+
+	// Test each new folder is recorded, so it can be undone
+	tu.MustFatal(cxt.Journal.Undo(1))
+	tu.AssertExists(filepath.Join(tu.Dir, "file1.txt"))
+	tu.AssertNotExists(filepath.Join(project, "Sorted"))
+}
+
+func TestSortMediaOffset(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	project := filepath.Join(tu.Dir, "project")
+	cxt := tu.MustFatal(context.NewContext(project)).(*context.Context)
+	sortedDir := filepath.Join(project, "Sorted")
+
+	file1 := filepath.Join(tu.Dir, "file1.txt")
+	file2 := filepath.Join(tu.Dir, "file2.txt")
+	evening := time.Date(2018, 10, 22, 23, 30, 0, 0, time.Local)
+	tu.MustFatal(os.Chtimes(file1, evening, evening))
+	tu.MustFatal(os.Chtimes(file2, evening, evening))
+
+	// Test offset pulls media back into the right day
+	tu.Must(SortMedia(cxt, &Options{Offset: -time.Hour}, file1))
+	tu.AssertExists(filepath.Join(sortedDir, "18-10-22", "file1.txt"))
+
+	tu.Must(SortMedia(cxt, &Options{Offset: time.Hour}, file2))
+	tu.AssertExists(filepath.Join(sortedDir, "18-10-23", "file2.txt"))
+}
+
+func TestSortMediaTimezone(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	project := filepath.Join(tu.Dir, "project")
+	cxt := tu.MustFatal(context.NewContext(project)).(*context.Context)
+
+	file1 := filepath.Join(tu.Dir, "file1.txt")
+	taken := time.Date(2018, 10, 22, 20, 0, 0, 0, time.UTC)
+	tu.MustFatal(os.Chtimes(file1, taken, taken))
+
+	// Test date is moved into timezone. 20:00 UTC is the next morning in Tokyo (+9)
+	tu.Must(SortMedia(cxt, &Options{Location: time.FixedZone("Tokyo", 9*60*60)}, file1))
+	tu.AssertExists(filepath.Join(project, "Sorted", "18-10-23", "file1.txt"))
+}
+
+func TestSortMediaTimezoneEXIF(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	project := filepath.Join(tu.Dir, "project")
+	cxt := tu.MustFatal(context.NewContext(project)).(*context.Context)
+
+	// Test EXIF dates keep their time in the timezone. Taken just after midnight, in a timezone 12 hours behind local time
+	_, offset := time.Now().Zone()
+	tu.Must(SortMedia(cxt, &Options{Location: time.FixedZone("Far", offset-12*60*60)}, filepath.Join(tu.Dir, "IMG_0002.CR2")))
+	tu.AssertExists(filepath.Join(project, "Sorted", "18-10-23", "IMG_0002.CR2"))
+}
+
+func TestSortMediaCameraOffset(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	project := filepath.Join(tu.Dir, "project")
+	cxt := tu.MustFatal(context.NewContext(project)).(*context.Context)
+
+	// Test only the camera in config is corrected. Both taken just after midnight
+	tu.Must(SortMedia(cxt, nil, filepath.Join(tu.Dir, "IMG_0001.CR2"), filepath.Join(tu.Dir, "IMG_0002.CR2")))
+	tu.AssertExists(
+		filepath.Join(project, "Sorted", "18-10-22", "IMG_0001.CR2"),
+		filepath.Join(project, "Sorted", "18-10-23", "IMG_0002.CR2"),
+	)
+}
+
+func TestSortMediaVerify(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	project := filepath.Join(tu.Dir, "project")
+	incoming := filepath.Join(tu.Dir, "incoming")
+	dateDir := filepath.Join(project, "Sorted", "18-10-22")
+	cxt := tu.MustFatal(context.NewContext(project)).(*context.Context)
+	tu.ModTime(2018, 10, 22, filepath.Join(incoming, "a.txt"), filepath.Join(incoming, "b.txt"))
+
+	// Test verified copies land, leaving the originals alone
+	tu.Must(SortMedia(cxt, &Options{Copy: true, Verify: true}, incoming))
+	tu.AssertExists(
+		filepath.Join(dateDir, "a.txt"),
+		filepath.Join(dateDir, "b.txt"),
+		filepath.Join(incoming, "a.txt"),
+		filepath.Join(incoming, "b.txt"),
+	)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if tu.Must(lock.HashFile(filepath.Join(dateDir, name))) != tu.Must(lock.HashFile(filepath.Join(incoming, name))) {
+			tu.Fail("Copy does not match", name)
+		}
+	}
+}
+
+func TestSortMediaPairs(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	project := filepath.Join(tu.Dir, "project")
+	incoming := filepath.Join(tu.Dir, "incoming")
+	cxt := tu.MustFatal(context.NewContext(project)).(*context.Context)
+	tu.ModTime(2018, 10, 25, filepath.Join(incoming, "IMG_0002.JPG"))
+
+	// Test the JPEG follows its RAW, even though its own date differs
+	tu.Must(SortMedia(cxt, nil, incoming))
+	tu.AssertExists(
+		filepath.Join(project, "Sorted", "18-10-23", "IMG_0002.CR2"),
+		filepath.Join(project, "Sorted", "18-10-23", "IMG_0002.JPG"),
+		filepath.Join(project, "Sorted", "18-10-23", "IMG_0002.xmp"),
+	)
+	tu.AssertNotExists(filepath.Join(project, "Sorted", "18-10-25"))
+}
+
+func TestSortMediaPairsCollide(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	project := filepath.Join(tu.Dir, "project")
+	incoming := filepath.Join(tu.Dir, "incoming")
+	dateDir := filepath.Join(project, "Sorted", "18-10-23")
+	cxt := tu.MustFatal(context.NewContext(project)).(*context.Context)
+
+	// Test the pair is renamed together, when only one of them is taken
+	tu.Must(SortMedia(cxt, nil, incoming))
+	tu.AssertExists(
+		filepath.Join(dateDir, "IMG_0002.JPG"),
+		filepath.Join(dateDir, "IMG_0002_1.CR2"),
+		filepath.Join(dateDir, "IMG_0002_1.JPG"),
+		filepath.Join(dateDir, "IMG_0002_1.xmp"),
+	)
+	tu.AssertNotExists(filepath.Join(dateDir, "IMG_0002.CR2"), filepath.Join(dateDir, "IMG_0002.xmp"))
+}
+
+func TestSortMediaDuplicates(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	project := filepath.Join(tu.Dir, "project")
+	incoming := filepath.Join(tu.Dir, "incoming")
+	dateDir := filepath.Join(project, "Sorted", "18-10-22")
+	cxt := tu.MustFatal(context.NewContext(project)).(*context.Context)
+	tu.MustFatal(lock.LockEvent(cxt, filepath.Join(project, "event01"), false))
+	tu.ModTime(2018, 10, 22,
+		filepath.Join(incoming, "a.txt"), // Same as locked media
+		filepath.Join(incoming, "b.txt"), // Same as sorted media
+		filepath.Join(incoming, "c.txt"), // Same as d.txt
+		filepath.Join(incoming, "d.txt"),
+		filepath.Join(incoming, "e.txt"),
+	)
+
+	// Test duplicates are left behind
+	tu.Must(SortMedia(cxt, nil, incoming))
+	tu.AssertExists(
+		filepath.Join(dateDir, "c.txt"),
+		filepath.Join(dateDir, "e.txt"),
+		filepath.Join(incoming, "a.txt"),
+		filepath.Join(incoming, "b.txt"),
+		filepath.Join(incoming, "d.txt"),
+	)
+	tu.AssertNotExists(
+		filepath.Join(dateDir, "a.txt"),
+		filepath.Join(dateDir, "b.txt"),
+		filepath.Join(dateDir, "d.txt"),
+	)
+
+	// Test duplicates can still be sorted if asked
+	tu.Must(SortMedia(cxt, &Options{AllowDuplicates: true}, incoming))
+	tu.AssertExists(
+		filepath.Join(dateDir, "a.txt"),
+		filepath.Join(dateDir, "b.txt"),
+		filepath.Join(dateDir, "d.txt"),
+	)
+}
+
+func TestSortMediaRecursive(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	project := filepath.Join(tu.Dir, "project")
+	card := filepath.Join(tu.Dir, "card")
+	dir1 := filepath.Join(card, "DCIM", "100CANON")
+	dir2 := filepath.Join(card, "DCIM", "101CANON")
+	dateDir := filepath.Join(project, "Sorted", "18-10-22")
+	cxt := tu.MustFatal(context.NewContext(project)).(*context.Context)
+	cxt.Config.SortExclude = append(cxt.Config.SortExclude, "misc")
+	tu.ModTime(2018, 10, 22,
+		filepath.Join(dir1, "IMG_0001.JPG"),
+		filepath.Join(dir1, "IMG_0003.JPG"),
+		filepath.Join(dir1, "orphan.aae"),
+		filepath.Join(dir2, "IMG_0002.JPG"),
+		filepath.Join(card, "MISC", "AUTPRINT.MRK"),
+	)
+	tu.ModTime(2018, 10, 25, // Sidecars follow their media, not their own dates
+		filepath.Join(dir1, "IMG_0001.xmp"),
+		filepath.Join(dir1, "IMG_0003.XMP"),
+		filepath.Join(dir2, "IMG_0002.JPG.xmp"),
+	)
+
+	// Test nothing is picked up from the top of the card without recursion
+	tu.Must(SortMedia(cxt, nil, card))
+	tu.AssertNotExists(filepath.Join(dateDir, "IMG_0001.JPG"))
+
+	// Test recursive sort brings media and sidecars, leaving junk behind
+	tu.Must(SortMedia(cxt, &Options{Recursive: true}, card))
+	tu.AssertExists(
+		filepath.Join(dateDir, "IMG_0001.JPG"),
+		filepath.Join(dateDir, "IMG_0001.xmp"),
+		filepath.Join(dateDir, "IMG_0002.JPG"),
+		filepath.Join(dateDir, "IMG_0002.JPG.xmp"),
+		filepath.Join(dateDir, "IMG_0003_1.JPG"), // Renamed around existing media, sidecar to match
+		filepath.Join(dateDir, "IMG_0003_1.XMP"),
+		filepath.Join(dateDir, "orphan.aae"), // Nothing to pair with. Sorted on its own
+		filepath.Join(dir1, "IMG_0001.THM"),
+		filepath.Join(card, "Thumbs.db"),
+		filepath.Join(card, "MISC", "AUTPRINT.MRK"),
+	)
+	tu.AssertNotExists(filepath.Join(project, "Sorted", "18-10-25"))
+}
+
+func TestSortMediaSkipSidecars(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	project := filepath.Join(tu.Dir, "project")
+	card := filepath.Join(tu.Dir, "card")
+	dateDir := filepath.Join(project, "Sorted", "18-10-22")
+	cxt := tu.MustFatal(context.NewContext(project)).(*context.Context)
+	cxt.Config.SortInclude = config.Patterns{"*.jpg"}
+	tu.ModTime(2018, 10, 22, filepath.Join(card, "IMG_0001.JPG"), filepath.Join(card, "IMG_0002.MOV"))
+
+	// Test only included media is sorted, without sidecars
+	tu.Must(SortMedia(cxt, &Options{SkipSidecars: true}, card))
+	tu.AssertExists(
+		filepath.Join(dateDir, "IMG_0001.JPG"),
+		filepath.Join(card, "IMG_0001.xmp"),
+		filepath.Join(card, "IMG_0002.MOV"),
+	)
+	tu.AssertNotExists(filepath.Join(dateDir, "IMG_0001.xmp"))
+}
@@ -2,13 +2,20 @@ package tags
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/internetimagery/photos/context"
 	"github.com/internetimagery/photos/format"
+	"github.com/internetimagery/photos/journal"
+	"github.com/internetimagery/photos/lock"
 )
 
+// move : Swappable for testing renames that fail partway through
+var move = (*journal.Journal).Move
+
 // getMedia : Helper to get media, and validate things
 func getMedia(filename string) (*format.Media, error) {
 	media := format.NewMedia(filename)
@@ -24,19 +31,58 @@ func getMedia(filename string) (*format.Media, error) {
 	return media, nil
 }
 
-// AddTag : Apply tagnames to a file
-func AddTag(filenames []string, tagnames []string) error {
+// withPairs : Include media that belongs with the given files (ie sidecars sharing the same index), so they can be tagged in lockstep
+func withPairs(filenames []string) ([]string, error) {
+	found := map[string]struct{}{}
+	paired := []string{}
+	add := func(filename string) {
+		if _, ok := found[filename]; !ok {
+			found[filename] = struct{}{}
+			paired = append(paired, filename)
+		}
+	}
+	for _, filename := range filenames {
+		filename = filepath.Clean(filename)
+		add(filename)
+		media := format.NewMedia(filename)
+		if media.Index == 0 {
+			continue
+		}
+		mediaList, err := format.GetMediaFromDirectory(filepath.Dir(filename))
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range format.GroupMedia(mediaList) {
+			for _, member := range group {
+				if member.Path == filename {
+					for _, pair := range group {
+						add(pair.Path)
+					}
+				}
+			}
+		}
+	}
+	return paired, nil
+}
+
+// AddTag : Apply tagnames to a file, and any media that belongs with it (ie sidecars). Returns the files renamed, mapped to their new names
+func AddTag(cxt *context.Context, filenames []string, tagnames []string) (map[string]string, error) {
+	renamed := map[string]string{}
+	filenames, err := withPairs(filenames)
+	if err != nil {
+		return renamed, err
+	}
 	for _, filename := range filenames {
 		media, err := getMedia(filename)
 		if err != nil {
-			return err
+			return renamed, err
 		}
 		if media.Index == 0 { // Media not formatted. Leave it alone
 			continue
 		}
 		oldname, err := media.FormatName()
 		if err != nil {
-			return err
+			return renamed, err
 		}
 		// Apply tags
 		for _, tagname := range tagnames {
@@ -48,7 +94,7 @@ func AddTag(filenames []string, tagnames []string) error {
 		// Build new path
 		newname, err := media.FormatName()
 		if err != nil {
-			return err
+			return renamed, err
 		} else if oldname == newname { // Nothing has changed. Nothing to do...
 			continue
 		}
@@ -57,30 +103,37 @@ func AddTag(filenames []string, tagnames []string) error {
 		// Ensure newpath does not exist
 		if _, err := os.Stat(newPath); !os.IsNotExist(err) {
 			if err == nil {
-				return os.ErrExist
+				return renamed, os.ErrExist
 			}
-			return err
+			return renamed, err
 		}
-		if err := os.Rename(filename, newPath); err != nil {
-			return err
+		log.Println("Renaming:", filename, "--->", newPath)
+		if err := cxt.Journal.Move(filename, newPath); err != nil {
+			return renamed, err
 		}
+		renamed[filename] = newPath
 	}
-	return nil
+	return renamed, nil
 }
 
-// RemoveTag : Remove tagnames from a file
-func RemoveTag(filenames []string, tagnames []string) error {
+// RemoveTag : Remove tagnames from a file, and any media that belongs with it (ie sidecars). Returns the files renamed, mapped to their new names
+func RemoveTag(cxt *context.Context, filenames []string, tagnames []string) (map[string]string, error) {
+	renamed := map[string]string{}
+	filenames, err := withPairs(filenames)
+	if err != nil {
+		return renamed, err
+	}
 	for _, filename := range filenames {
 		media, err := getMedia(filename)
 		if err != nil {
-			return err
+			return renamed, err
 		}
 		if media.Index == 0 { // Media not formatted. Leave it alone
 			continue
 		}
 		oldname, err := media.FormatName()
 		if err != nil {
-			return err
+			return renamed, err
 		}
 		// Remove tags
 		for _, tagname := range tagnames {
@@ -88,7 +141,7 @@ func RemoveTag(filenames []string, tagnames []string) error {
 		}
 		newname, err := media.FormatName()
 		if err != nil {
-			return err
+			return renamed, err
 		} else if oldname == newname { // No change. We're done here!
 			continue
 		}
@@ -98,13 +151,180 @@ func RemoveTag(filenames []string, tagnames []string) error {
 		// Ensure newpath does not exist
 		if _, err := os.Stat(newPath); !os.IsNotExist(err) {
 			if err == nil {
-				return os.ErrExist
+				return renamed, os.ErrExist
 			}
+			return renamed, err
+		}
+		log.Println("Renaming:", filename, "--->", newPath)
+		if err := cxt.Journal.Move(filename, newPath); err != nil {
+			return renamed, err
+		}
+		renamed[filename] = newPath
+	}
+	return renamed, nil
+}
+
+// CollectTags : Gather all tags used on formatted media across the project, along with how many times they are used
+func CollectTags(cxt *context.Context) (map[string]int, error) {
+	tagCount := map[string]int{}
+	err := cxt.WalkEvents(func(eventPath string) error {
+		mediaList, err := format.GetMediaFromDirectory(eventPath)
+		if err != nil {
 			return err
 		}
-		if err := os.Rename(filename, newPath); err != nil {
+		for _, media := range mediaList {
+			if media.Index == 0 { // Media not formatted. Tags don't count
+				continue
+			}
+			for tagname := range media.Tags {
+				tagCount[tagname]++
+			}
+		}
+		return nil
+	})
+	return tagCount, err
+}
+
+// Distance : Number of single character edits required to turn one tag into another (levenshtein distance). Case insensitive.
+func Distance(tag1, tag2 string) int {
+	runes1, runes2 := []rune(strings.ToLower(tag1)), []rune(strings.ToLower(tag2))
+	previous := make([]int, len(runes2)+1)
+	current := make([]int, len(runes2)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(runes1); i++ {
+		current[0] = i
+		for j := 1; j <= len(runes2); j++ {
+			cost := 1
+			if runes1[i-1] == runes2[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost // Substitution
+			if previous[j]+1 < current[j] {   // Deletion
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] { // Insertion
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(runes2)]
+}
+
+// SuggestTag : Look for an existing tag that is spelled similarly to (but not the same as) the given tag. Empty string if none.
+// The closest tag wins, with the most used tag breaking ties.
+func SuggestTag(tagname string, existing map[string]int) string {
+	if _, ok := existing[tagname]; ok { // Tag exists already. Nothing to suggest
+		return ""
+	}
+	maxDistance := 1 // Allow more mistakes on longer tags
+	if len([]rune(tagname)) > 4 {
+		maxDistance = 2
+	}
+	suggestion, bestDistance := "", maxDistance+1
+	for existingTag, count := range existing {
+		dist := Distance(tagname, existingTag)
+		if dist < bestDistance || (dist == bestDistance && suggestion != "" && (count > existing[suggestion] || (count == existing[suggestion] && existingTag < suggestion))) {
+			suggestion, bestDistance = existingTag, dist
+		}
+	}
+	return suggestion
+}
+
+// ReplaceTags : Swap old tags for a new tag on all formatted media across the project (rename or merge tags).
+// Locked events have their lockfile updated to follow the new names. Returns a map of old paths to new paths (those renamed before any error).
+func ReplaceTags(cxt *context.Context, oldTags []string, newTag string) (map[string]string, error) {
+	newTag = strings.TrimSpace(newTag)
+	if newTag == "" {
+		return nil, fmt.Errorf("no tag to replace with")
+	}
+
+	// Work out all renames first, so we can bail before changing anything
+	renameMap := map[string]string{}
+	targets := map[string]struct{}{} // New paths, so two files are never renamed onto one another
+	eventMap := map[string][]string{}
+	err := cxt.WalkEvents(func(eventPath string) error {
+		mediaList, err := format.GetMediaFromDirectory(eventPath)
+		if err != nil {
 			return err
 		}
+		for _, media := range mediaList {
+			if media.Index == 0 { // Media not formatted. Leave it alone
+				continue
+			}
+			found := false
+			for _, tagname := range oldTags {
+				if _, ok := media.Tags[tagname]; ok {
+					delete(media.Tags, tagname)
+					found = true
+				}
+			}
+			if !found {
+				continue
+			}
+			media.Tags[newTag] = struct{}{}
+			newname, err := media.FormatName()
+			if err != nil {
+				return err
+			}
+			newPath := filepath.Join(eventPath, newname)
+			if newPath == media.Path {
+				continue
+			}
+			// Ensure newpath does not exist
+			if _, err := os.Stat(newPath); !os.IsNotExist(err) {
+				if err == nil {
+					return os.ErrExist
+				}
+				return err
+			}
+			if _, ok := targets[newPath]; ok { // Another file is already taking this name
+				return os.ErrExist
+			}
+			targets[newPath] = struct{}{}
+			renameMap[media.Path] = newPath
+			eventMap[eventPath] = append(eventMap[eventPath], media.Path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Rename our files, and their entries in the lock. If we stop partway, the lock still follows what was renamed
+	renamed := map[string]string{}
+	for eventPath, filenames := range eventMap {
+		lockmap, err := lock.ReadLockFile(eventPath)
+		locked := err == nil
+		if err != nil && !os.IsNotExist(err) {
+			return renamed, err
+		}
+		var moveErr error
+		for _, filename := range filenames {
+			newPath := renameMap[filename]
+			if moveErr = move(cxt.Journal, filename, newPath); moveErr != nil {
+				break
+			}
+			renamed[filename] = newPath
+			if sshot, ok := lockmap[filepath.Base(filename)]; ok {
+				delete(lockmap, filepath.Base(filename))
+				sshot.Name = filepath.Base(newPath)
+				lockmap[sshot.Name] = sshot
+			}
+		}
+		if locked && !cxt.Journal.IsDryRun() {
+			if err = cxt.Journal.Keep(filepath.Join(eventPath, lock.LOCKFILENAME)); err != nil {
+				return renamed, err
+			}
+			if err = lock.WriteLockFile(eventPath, lockmap); err != nil {
+				return renamed, err
+			}
+		}
+		if moveErr != nil {
+			return renamed, moveErr
+		}
 	}
-	return nil
+	return renamed, nil
 }
@@ -1,55 +1,88 @@
 package tags
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/internetimagery/photos/context"
+	"github.com/internetimagery/photos/journal"
+	"github.com/internetimagery/photos/lock"
 	"github.com/internetimagery/photos/testutil"
 )
 
 func TestAddTag(t *testing.T) {
 	tu := testutil.NewTestUtil(t)
 	defer tu.LoadTestdata()()
+	cxt := new(context.Context)
 
 	// Test adding a tag adjusts file
 	testfile := filepath.Join(tu.Dir, "event01", "event01_001.txt")
-	tu.Must(AddTag([]string{testfile}, []string{"one"}))
+	tu.Must(AddTag(cxt, []string{testfile}, []string{"one"}))
 	testfile = filepath.Join(tu.Dir, "event01", "event01_001[one].txt")
 	tu.AssertExists(testfile)
 	// Test adding tag again
-	tu.Must(AddTag([]string{testfile}, []string{"two"}))
+	tu.Must(AddTag(cxt, []string{testfile}, []string{"two"}))
 	testfile = filepath.Join(tu.Dir, "event01", "event01_001[one two].txt")
 	tu.AssertExists(testfile)
 	// Test adding duplicate tag doesn't add it
-	tu.Must(AddTag([]string{testfile}, []string{"two"}))
+	tu.Must(AddTag(cxt, []string{testfile}, []string{"two"}))
 	testfile = filepath.Join(tu.Dir, "event01", "event01_001[one two].txt")
 	tu.AssertExists(testfile)
 	// Test adding duplicate tags and real tags still ignores duplicates
-	tu.Must(AddTag([]string{testfile}, []string{"one", "two", "three"}))
+	tu.Must(AddTag(cxt, []string{testfile}, []string{"one", "two", "three"}))
 	testfile = filepath.Join(tu.Dir, "event01", "event01_001[one three two].txt")
 	tu.AssertExists(testfile)
 	// Test adding no tags does nothing
-	tu.Must(AddTag([]string{testfile}, []string{""}))
+	tu.Must(AddTag(cxt, []string{testfile}, []string{""}))
 	testfile = filepath.Join(tu.Dir, "event01", "event01_001[one three two].txt")
 	tu.AssertExists(testfile)
 	// Test adding no tags
 	testfile = filepath.Join(tu.Dir, "event01", "event01_002.txt")
-	tu.Must(AddTag([]string{testfile}, []string{""}))
+	tu.Must(AddTag(cxt, []string{testfile}, []string{""}))
 	tu.AssertExists(testfile)
 	// Test adding tags to unadded file does nothing
 	testfile = filepath.Join(tu.Dir, "event01", "notpartofevent.txt")
-	tu.Must(AddTag([]string{testfile}, []string{"one", "two"}))
+	tu.Must(AddTag(cxt, []string{testfile}, []string{"one", "two"}))
 	tu.AssertExists(testfile)
 }
 
+func TestAddTagSidecar(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+	cxt := new(context.Context)
+	event := filepath.Join(tu.Dir, "event01")
+
+	// Test tagging a file brings its sidecar along
+	tu.Must(AddTag(cxt, []string{filepath.Join(event, "event01_001.jpg")}, []string{"one"}))
+	tu.AssertExists(
+		filepath.Join(event, "event01_001[one].jpg"),
+		filepath.Join(event, "event01_001[one].xmp"),
+	)
+	// Test tagging the sidecar works the other way, and RAW+JPEG pairs stay together
+	tu.Must(AddTag(cxt, []string{filepath.Join(event, "event01_002.cr2")}, []string{"two"}))
+	tu.AssertExists(
+		filepath.Join(event, "event01_002[two].cr2"),
+		filepath.Join(event, "event01_002[two].jpg"),
+		filepath.Join(event, "event01_003.jpg"),
+	)
+	// Test removing tags follows along too
+	tu.Must(RemoveTag(cxt, []string{filepath.Join(event, "event01_001[one].xmp")}, []string{"one"}))
+	tu.AssertExists(
+		filepath.Join(event, "event01_001.jpg"),
+		filepath.Join(event, "event01_001.xmp"),
+	)
+}
+
 func TestAddTagExisting(t *testing.T) {
 	tu := testutil.NewTestUtil(t)
 	defer tu.LoadTestdata()()
+	cxt := new(context.Context)
 
 	// Test adding tag with existing file fails dramatically!
 	testfile := filepath.Join(tu.Dir, "event01", "event01_001[one].txt")
-	if err := AddTag([]string{testfile}, []string{"two"}); !os.IsExist(err) {
+	if _, err := AddTag(cxt, []string{testfile}, []string{"two"}); !os.IsExist(err) {
 		if err == nil {
 			tu.Fail("Succeeded in overwriting a file!")
 		} else {
@@ -63,36 +96,38 @@ func TestAddTagExisting(t *testing.T) {
 func TestRemoveTag(t *testing.T) {
 	tu := testutil.NewTestUtil(t)
 	defer tu.LoadTestdata()()
+	cxt := new(context.Context)
 
 	// Test removing tag from file with no tags does nothing
 	testfile := filepath.Join(tu.Dir, "event01", "event01_001.txt")
-	tu.Must(RemoveTag([]string{testfile}, []string{"one"}))
+	tu.Must(RemoveTag(cxt, []string{testfile}, []string{"one"}))
 	tu.AssertExists(testfile)
 	// Test removing tag from file removes tag... from file (and braces)
 	testfile = filepath.Join(tu.Dir, "event01", "event01_002[one].txt")
-	tu.Must(RemoveTag([]string{testfile}, []string{"one"}))
+	tu.Must(RemoveTag(cxt, []string{testfile}, []string{"one"}))
 	tu.AssertExists(filepath.Join(tu.Dir, "event01", "event01_002.txt"))
 	// Test removing tag from file removes tag...
 	testfile = filepath.Join(tu.Dir, "event01", "event01_003[one two].txt")
-	tu.Must(RemoveTag([]string{testfile}, []string{"one"}))
+	tu.Must(RemoveTag(cxt, []string{testfile}, []string{"one"}))
 	tu.AssertExists(filepath.Join(tu.Dir, "event01", "event01_003[two].txt"))
 	// Test removing tags that don't exist, does nothing
 	testfile = filepath.Join(tu.Dir, "event01", "event01_004[one two].txt")
-	tu.Must(RemoveTag([]string{testfile}, []string{"three"}))
+	tu.Must(RemoveTag(cxt, []string{testfile}, []string{"three"}))
 	tu.AssertExists(testfile)
 	// Test removing nothing does nothing
 	testfile = filepath.Join(tu.Dir, "event01", "event01_004[one two].txt")
-	tu.Must(RemoveTag([]string{testfile}, []string{""}))
+	tu.Must(RemoveTag(cxt, []string{testfile}, []string{""}))
 	tu.AssertExists(testfile)
 }
 
 func TestRemoveTagExisting(t *testing.T) {
 	tu := testutil.NewTestUtil(t)
 	defer tu.LoadTestdata()()
+	cxt := new(context.Context)
 
 	// Test removing tag from file with no tags does nothing
 	testfile := filepath.Join(tu.Dir, "event01", "event01_001[one two].txt")
-	if err := RemoveTag([]string{testfile}, []string{"one"}); !os.IsExist(err) {
+	if _, err := RemoveTag(cxt, []string{testfile}, []string{"one"}); !os.IsExist(err) {
 		if err == nil {
 			tu.Fail("Allowed overwriting existing file!")
 		} else {
@@ -102,3 +137,180 @@ func TestRemoveTagExisting(t *testing.T) {
 	tu.AssertExists(filepath.Join(tu.Dir, "event01", "event01_001[two].txt"))
 	tu.AssertExists(testfile)
 }
+
+func TestCollectTags(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	cxt := tu.MustFatal(context.NewContext(tu.Dir)).(*context.Context)
+	tagCount := tu.MustFatal(CollectTags(cxt)).(map[string]int)
+
+	expect := map[string]int{"alice": 3, "bob": 1}
+	if len(tagCount) != len(expect) {
+		tu.FailE(expect, tagCount)
+	}
+	for tagname, count := range expect {
+		if tagCount[tagname] != count {
+			tu.FailE(expect, tagCount)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+
+	testCase := []struct {
+		tag1, tag2 string
+		dist       int
+	}{
+		{"alice", "alice", 0},
+		{"alice", "Alice", 0},
+		{"alice", "alcie", 2},
+		{"alice", "alic", 1},
+		{"alice", "malice", 1},
+		{"", "bob", 3},
+		{"kitten", "sitting", 3},
+	}
+	for _, test := range testCase {
+		if dist := Distance(test.tag1, test.tag2); dist != test.dist {
+			tu.FailE(test, dist)
+		}
+	}
+}
+
+func TestSuggestTag(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+
+	existing := map[string]int{"alice": 10, "alicia": 2, "bob": 5, "rob": 1}
+
+	testCase := map[string]string{
+		"alice":  "",      // Already exists
+		"alcie":  "alice", // Swapped letters
+		"Alice":  "alice", // Case
+		"alici":  "alice", // Tie goes to the most used
+		"bobb":   "bob",
+		"cob":    "bob",
+		"carol":  "",
+		"bo":     "bob",
+		"robert": "",
+	}
+	for tagname, expect := range testCase {
+		if suggestion := SuggestTag(tagname, existing); suggestion != expect {
+			tu.Fail("Tag:", tagname, "Expected:", expect, "Got:", suggestion)
+		}
+	}
+}
+
+func TestReplaceTags(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	cxt := tu.MustFatal(context.NewContext(tu.Dir)).(*context.Context)
+	event := filepath.Join(tu.Dir, "event01")
+	tu.MustFatal(lock.LockEvent(cxt, event, false))
+
+	// Merge misspelled tags into one
+	renameMap := tu.MustFatal(ReplaceTags(cxt, []string{"alcie", "alicia"}, "alice")).(map[string]string)
+	if len(renameMap) != 3 {
+		tu.Fail("Expected three renames", renameMap)
+	}
+	tu.AssertExists(
+		filepath.Join(event, "event01_001[alice bob].txt"),
+		filepath.Join(event, "event01_002[alice].txt"),
+		filepath.Join(event, "event01_003[alice].txt"),
+		filepath.Join(tu.Dir, "2018", "event02", "event02_001[alice].txt"),
+	)
+
+	// Lock should follow the renames
+	lockmap := tu.MustFatal(lock.ReadLockFile(event)).(lock.LockMap)
+	if sshot, ok := lockmap["event01_001[alice bob].txt"]; !ok || sshot.Name != "event01_001[alice bob].txt" {
+		tu.Fail("Lock entry was not renamed")
+	}
+	if _, ok := lockmap["event01_001[alcie bob].txt"]; ok {
+		tu.Fail("Old lock entry remains")
+	}
+	tu.Must(lock.LockEvent(cxt, event, false))
+
+	// Rename a tag
+	tu.Must(ReplaceTags(cxt, []string{"bob"}, "robert"))
+	tu.AssertExists(filepath.Join(event, "event01_001[alice robert].txt"))
+}
+
+func TestReplaceTagsExisting(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	cxt := tu.MustFatal(context.NewContext(tu.Dir)).(*context.Context)
+	event := filepath.Join(tu.Dir, "event01")
+
+	// Test renaming onto an existing file fails without changing anything
+	if _, err := ReplaceTags(cxt, []string{"one"}, "two"); !os.IsExist(err) {
+		if err == nil {
+			tu.Fail("Allowed overwriting existing file!")
+		} else {
+			tu.Fail(err)
+		}
+	}
+	tu.AssertExists(
+		filepath.Join(event, "event01_001[one].txt"),
+		filepath.Join(event, "event01_001[two].txt"),
+		filepath.Join(event, "event01_002[one].txt"),
+	)
+}
+
+func TestReplaceTagsCollide(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	cxt := tu.MustFatal(context.NewContext(tu.Dir)).(*context.Context)
+	event := filepath.Join(tu.Dir, "event01")
+
+	// Test merging tags that would rename two files onto the same name fails without changing anything
+	if _, err := ReplaceTags(cxt, []string{"one", "two"}, "three"); !os.IsExist(err) {
+		if err == nil {
+			tu.Fail("Allowed merging two files into one!")
+		} else {
+			tu.Fail(err)
+		}
+	}
+	tu.AssertExists(
+		filepath.Join(event, "event01_001[one].txt"),
+		filepath.Join(event, "event01_001[two].txt"),
+	)
+	tu.AssertNotExists(filepath.Join(event, "event01_001[three].txt"))
+}
+
+func TestReplaceTagsFail(t *testing.T) {
+	tu := testutil.NewTestUtil(t)
+	defer tu.LoadTestdata()()
+
+	cxt := tu.MustFatal(context.NewContext(tu.Dir)).(*context.Context)
+	event := filepath.Join(tu.Dir, "event01")
+	tu.MustFatal(lock.LockEvent(cxt, event, false))
+
+	// Fail the second rename
+	defer func(original func(*journal.Journal, string, string) error) { move = original }(move)
+	moves := 0
+	move = func(journ *journal.Journal, source, dest string) error {
+		if moves++; moves > 1 {
+			return fmt.Errorf("failed to move")
+		}
+		return journ.Move(source, dest)
+	}
+
+	// Test what was renamed is reported, and the lock follows it
+	renameMap, err := ReplaceTags(cxt, []string{"one"}, "two")
+	if err == nil {
+		tu.Fail("Missed failed rename")
+	}
+	if len(renameMap) != 1 || renameMap[filepath.Join(event, "event01_001[one].txt")] != filepath.Join(event, "event01_001[two].txt") {
+		tu.Fail("Expected one rename. Got", renameMap)
+	}
+	tu.AssertExists(
+		filepath.Join(event, "event01_001[two].txt"),
+		filepath.Join(event, "event01_002[one].txt"),
+	)
+	if err := tu.Must(lock.VerifyEvent(event)).(lock.Results).Err(); err != nil {
+		tu.Fail("Lock does not follow the rename", err)
+	}
+}